@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/erneap/authentication/services"
+)
+
+// runCommand runs a maintenance command given on the command line in place of
+// the server, providing the process exit code.
+//
+//	verify-audit    check the audit trail for deleted or modified entries, with
+//	                the same settings flags as the server, e.g. -config
+//	encrypt         encrypt a setting with the master key, the value being
+//	                read from standard input so it's kept out of the shell
+//	                history and process list
+func runCommand(args []string) int {
+	switch args[0] {
+	case "verify-audit":
+		return verifyAudit(args[1:])
+	case "encrypt":
+		return encryptSetting(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+	return 2
+}
+
+func verifyAudit(args []string) int {
+	if err := services.LoadSettings(args); err != nil {
+		fmt.Fprintf(os.Stderr, "configuration problems:\n%s\n", err.Error())
+		return 2
+	}
+	services.ConnectMongo()
+	result, err := services.VerifyAuditChain(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-audit: %s\n", err.Error())
+		return 2
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
+
+func encryptSetting(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "encrypt: give the value on standard input, not as an argument")
+		return 2
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encrypt: %s\n", err.Error())
+		return 2
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	encrypted, err := services.EncryptSetting(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encrypt: %s\n", err.Error())
+		return 2
+	}
+	fmt.Println(encrypted)
+	return 0
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type AccountStatusRequest struct {
+	Status    string     `json:"status" binding:"required"`
+	Reason    string     `json:"reason"`
+	StartDate *time.Time `json:"startDate,omitempty"`
+	EndDate   *time.Time `json:"endDate,omitempty"`
+}
+
+type AccountStatusResponse struct {
+	Status    services.AccountStatus `json:"status"`
+	Effective string                 `json:"effective"`
+	Exception string                 `json:"exception"`
+}
+
+func GetAccountStatus(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := primitive.ObjectIDFromHex(c.Param("userid"))
+	if err != nil {
+		msg := "GetAccountStatus: Bad User ID: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAccountStatus", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	status, err := services.GetAccountStatus(ctx, id)
+	if err != nil {
+		msg := "GetAccountStatus Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAccountStatus", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, AccountStatusResponse{
+		Status:    *status,
+		Effective: status.Effective(time.Now().UTC()),
+		Exception: "",
+	})
+}
+
+func UpdateAccountStatus(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data AccountStatusRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAccountStatus",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.GetStores().Users.GetByID(ctx, c.Param("userid"))
+	if err != nil {
+		msg := "UpdateAccountStatus: GetUserByID Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAccountStatus", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	current, err := services.GetAccountStatus(ctx, user.ID)
+	if err != nil {
+		msg := "UpdateAccountStatus: GetAccountStatus Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAccountStatus", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	status := services.AccountStatus{
+		ID:        user.ID,
+		Status:    data.Status,
+		Reason:    data.Reason,
+		StartDate: data.StartDate,
+		EndDate:   data.EndDate,
+		UpdatedBy: svcs.GetRequestor(c),
+	}
+	if err := services.SetAccountStatus(ctx, status); err != nil {
+		msg := "UpdateAccountStatus Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAccountStatus", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionUserStatus, services.CategoryUpdate, *user,
+		"", "Account Status: "+data.Reason,
+		services.NewChange("status", current.Status, data.Status))
+
+	updated, err := services.GetAccountStatus(ctx, user.ID)
+	if err != nil {
+		msg := "UpdateAccountStatus: GetAccountStatus Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAccountStatus", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, AccountStatusResponse{
+		Status:    *updated,
+		Effective: updated.Effective(time.Now().UTC()),
+		Exception: "",
+	})
+}
@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+type AuditResponse struct {
+	Events    []services.AuditEvent `json:"events"`
+	Total     int64                 `json:"total"`
+	Page      int64                 `json:"page"`
+	PageSize  int64                 `json:"pageSize"`
+	Exception string                `json:"exception"`
+}
+
+// getAuditFilter reads the audit filter from the query parameters actor,
+// target, action, category, application, outcome, from and to.  Dates are
+// either RFC 3339 times or YYYY-MM-DD, with a date "to" including that day.
+func getAuditFilter(c *gin.Context) (services.AuditFilter, error) {
+	filter := services.AuditFilter{
+		ActorID:     c.Query("actor"),
+		TargetID:    c.Query("target"),
+		Action:      c.Query("action"),
+		Category:    c.Query("category"),
+		Application: c.Query("application"),
+		Outcome:     c.Query("outcome"),
+	}
+	var err error
+	if filter.From, err = parseAuditDate(c.Query("from"), false); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseAuditDate(c.Query("to"), true); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func parseAuditDate(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, errors.New("bad date: " + value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+func getQueryInt(c *gin.Context, name string, def, max int64) int64 {
+	value, err := strconv.ParseInt(c.Query(name), 10, 64)
+	if err != nil || value <= 0 {
+		return def
+	}
+	if max > 0 && value > max {
+		return max
+	}
+	return value
+}
+
+// GetAuditEvents provides a page of the audit trail, filtered by the query
+// parameters.  Pages are selected by page and pagesize (default 50, at most
+// 500).
+func GetAuditEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter, err := getAuditFilter(c)
+	if err != nil {
+		msg := "GetAuditEvents: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAuditEvents", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	page := getQueryInt(c, "page", 1, 0)
+	pageSize := getQueryInt(c, "pagesize", 50, 500)
+
+	events, total, err := services.GetAuditEvents(ctx, filter, page, pageSize)
+	if err != nil {
+		msg := "GetAuditEvents Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAuditEvents", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, AuditResponse{
+		Events:    events,
+		Total:     total,
+		Page:      page,
+		PageSize:  pageSize,
+		Exception: "",
+	})
+}
+
+// ExportAuditEvents downloads the events matching the filter as CSV or JSON,
+// chosen by the format query parameter, up to AUDIT_EXPORT_LIMIT events.
+func ExportAuditEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter, err := getAuditFilter(c)
+	if err != nil {
+		msg := "ExportAuditEvents: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "ExportAuditEvents", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	format := strings.ToLower(c.DefaultQuery("format", "csv"))
+	if format != "csv" && format != "json" {
+		msg := "ExportAuditEvents: unknown format: " + format
+		services.AddLogEntry(c, "authenticate", "Debug", "ExportAuditEvents", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	limit := int64(services.GetSettings().Audit.ExportLimit)
+	events, _, err := services.GetAuditEvents(ctx, filter, 1, limit)
+	if err != nil {
+		msg := "ExportAuditEvents Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "ExportAuditEvents", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	services.AddLogEntry(c, "authenticate", "SUCCESS", "ExportAuditEvents",
+		"Audit Exported: "+strconv.Itoa(len(events))+" events as "+format)
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	if format == "json" {
+		c.JSON(http.StatusOK, events)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := services.WriteAuditCSV(c.Writer, events); err != nil {
+		services.AddLogEntry(c, "authenticate", "ERROR", "ExportAuditEvents",
+			"CSV Problem: "+err.Error())
+	}
+}
+
+// GetUserTimeline provides the user's activity, both what they did and what
+// was done to their account, for the optional from and to dates.
+func GetUserTimeline(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("userid")
+	from, err := parseAuditDate(c.Query("from"), false)
+	if err != nil {
+		msg := "GetUserTimeline: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetUserTimeline", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	to, err := parseAuditDate(c.Query("to"), true)
+	if err != nil {
+		msg := "GetUserTimeline: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetUserTimeline", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	limit := getQueryInt(c, "limit", 200, 5000)
+
+	events, err := services.GetUserTimeline(ctx, id, from, to, limit)
+	if err != nil {
+		msg := "GetUserTimeline Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetUserTimeline", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, AuditResponse{
+		Events:    events,
+		Total:     int64(len(events)),
+		Page:      1,
+		PageSize:  limit,
+		Exception: "",
+	})
+}
+
+// VerifyAuditChain checks the audit trail for deleted or modified entries.
+func VerifyAuditChain(c *gin.Context) {
+	ctx := c.Request.Context()
+	result, err := services.VerifyAuditChain(ctx)
+	if err != nil {
+		msg := "VerifyAuditChain Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "VerifyAuditChain", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	if !result.Valid {
+		services.AddLogEntry(c, "authenticate", "ERROR", "VerifyAuditChain",
+			"Audit Chain Problems: "+strconv.Itoa(len(result.Problems)))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetAuditRollups provides the event counts by day or month, chosen by the
+// period query parameter, for the optional from and to dates.
+func GetAuditRollups(c *gin.Context) {
+	ctx := c.Request.Context()
+	period := strings.ToLower(c.DefaultQuery("period", "day"))
+	if period != "day" && period != "month" {
+		msg := "GetAuditRollups: unknown period: " + period
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAuditRollups", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	filter, err := getAuditFilter(c)
+	if err != nil {
+		msg := "GetAuditRollups: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAuditRollups", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	rollups, err := services.GetAuditRollups(ctx, period, filter.From, filter.To)
+	if err != nil {
+		msg := "GetAuditRollups Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAuditRollups", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, rollups)
+}
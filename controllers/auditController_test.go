@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+)
+
+func TestVerifyAuditChain(t *testing.T) {
+	useMemoryStores(t)
+	addTestUser(t, "audited@example.com")
+	login("audited@example.com", testPassword)
+	login("audited@example.com", "Wrong-Horse-42")
+	if _, err := services.CreateAuditCheckpoint(context.Background()); err != nil {
+		t.Fatalf("CreateAuditCheckpoint: %s", err.Error())
+	}
+	login("audited@example.com", testPassword)
+
+	w := serve(VerifyAuditChain, "GET", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var result services.AuditVerification
+	decode(t, w, &result)
+	if !result.Valid || len(result.Problems) != 0 {
+		t.Errorf("chain not valid: %+v", result.Problems)
+	}
+	if result.Checked < 3 || result.LastSeq != result.Checked {
+		t.Errorf("checked %d events to %d, want at least 3 in sequence",
+			result.Checked, result.LastSeq)
+	}
+	if result.Checkpoints != 1 {
+		t.Errorf("checkpoints = %d, want 1", result.Checkpoints)
+	}
+}
@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/employees"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BulkUserRequest asks for a single action to be applied to a group of users.
+// The users are provided directly by their IDs or selected by a filter of team
+// (and optionally site) or an existing workgroup.  When more than one of these
+// is given the request applies to the users matching all of them, e.g. the
+// members of a team in a workgroup.  Deactivated users and disabled accounts
+// are skipped and reported in the results.
+type BulkUserRequest struct {
+	Action    string   `json:"action" binding:"required"`
+	Value     string   `json:"value,omitempty"`
+	UserIDs   []string `json:"userids,omitempty"`
+	TeamID    string   `json:"team,omitempty"`
+	SiteID    string   `json:"site,omitempty"`
+	Workgroup string   `json:"workgroup,omitempty"`
+}
+
+type BulkUserResult struct {
+	ID        string `json:"id"`
+	Email     string `json:"email,omitempty"`
+	Success   bool   `json:"success"`
+	Exception string `json:"exception,omitempty"`
+}
+
+type BulkUserResponse struct {
+	Results   []BulkUserResult `json:"results"`
+	Exception string           `json:"exception"`
+}
+
+// bulkActions are the only update fields allowed in a bulk request, names,
+// emails and passwords are always changed one user at a time.
+var bulkActions = map[string]bool{
+	"addperm":          true,
+	"addworkgroup":     true,
+	"addpermission":    true,
+	"removeworkgroup":  true,
+	"remove":           true,
+	"removeperm":       true,
+	"removepermission": true,
+	"unlock":           true,
+	"5days":            true,
+}
+
+func BulkUpdateUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data BulkUserRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionUserUpdate, "",
+			fmt.Sprintf("BulkUpdateUsers: Data Binding: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			BulkUserResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	action := strings.ToLower(data.Action)
+	if !bulkActions[action] {
+		msg := fmt.Sprintf("BulkUpdateUsers: Action not allowed: %s", data.Action)
+		services.AuditFailure(c, services.ActionUserUpdate, "", msg)
+		c.JSON(http.StatusBadRequest, BulkUserResponse{Exception: msg})
+		return
+	}
+	if strings.HasPrefix(action, "add") || strings.HasPrefix(action, "remove") {
+		if data.Value == "" {
+			msg := "BulkUpdateUsers: Workgroup value required"
+			services.AuditFailure(c, services.ActionUserUpdate, "", msg)
+			c.JSON(http.StatusBadRequest, BulkUserResponse{Exception: msg})
+			return
+		}
+	}
+
+	ids, err := getBulkUserIDs(ctx, data)
+	if err != nil {
+		msg := "BulkUpdateUsers: User Selection Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionUserUpdate, "", msg)
+		c.JSON(http.StatusBadRequest, BulkUserResponse{Exception: msg})
+		return
+	}
+
+	var results []BulkUserResult
+	for _, id := range ids {
+		result := BulkUserResult{ID: id}
+		user, err := services.GetStores().Users.GetByID(ctx, id)
+		if err != nil {
+			result.Exception = "GetUserByID Problem: " + err.Error()
+			results = append(results, result)
+			continue
+		}
+		result.Email = user.EmailAddress
+		skip, err := getBulkSkipReason(ctx, user.ID)
+		if err != nil {
+			result.Exception = "Account Status Problem: " + err.Error()
+			results = append(results, result)
+			continue
+		} else if skip != "" {
+			result.Exception = "Skipped: " + skip
+			results = append(results, result)
+			continue
+		}
+
+		before := services.CopyUser(*user)
+		applyUserUpdate(user, action, data.Value)
+		if err = services.GetStores().Users.Update(ctx, *user); err != nil {
+			result.Exception = "UpdateUser Problem: " + err.Error()
+			services.AuditUser(c, services.ActionUserUpdate, services.CategoryError,
+				before, "", "Bulk Update Problem: "+err.Error())
+			results = append(results, result)
+			continue
+		}
+		result.Success = true
+		services.AuditUser(c, services.ActionUserUpdate, services.CategoryUpdate, *user,
+			"", "Bulk Update: "+action, services.DiffUsers(before, *user)...)
+		alertUserUpdate(c, *user, action, data.Value)
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, BulkUserResponse{Results: results, Exception: ""})
+}
+
+// getBulkUserIDs provides the list of user IDs a bulk request applies to, the
+// users matching every selection given: the explicit list of user IDs, the
+// team/site filter and the workgroup filter.
+func getBulkUserIDs(ctx context.Context, data BulkUserRequest) ([]string, error) {
+	var ids []string
+	var selected map[string]bool
+	match := func(found []string) {
+		matched := make(map[string]bool)
+		var kept []string
+		for _, id := range found {
+			if id != "" && !matched[id] && (selected == nil || selected[id]) {
+				matched[id] = true
+				kept = append(kept, id)
+			}
+		}
+		ids, selected = kept, matched
+	}
+
+	if len(data.UserIDs) > 0 {
+		match(data.UserIDs)
+	}
+
+	if data.TeamID != "" {
+		var err error
+		var emps []employees.Employee
+		if data.SiteID != "" {
+			emps, err = services.GetEmployees(ctx, data.TeamID, data.SiteID)
+		} else {
+			emps, err = services.GetEmployeesForTeam(ctx, data.TeamID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var found []string
+		for _, emp := range emps {
+			found = append(found, emp.ID.Hex())
+		}
+		match(found)
+	}
+
+	if data.Workgroup != "" {
+		usrs, err := services.GetStores().Users.GetAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var found []string
+		for _, user := range usrs {
+			if hasWorkgroup(user, data.Workgroup) {
+				found = append(found, user.ID.Hex())
+			}
+		}
+		match(found)
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("no users selected")
+	}
+	return ids, nil
+}
+
+// getBulkSkipReason provides why the user is left out of a bulk update, or
+// nothing when the user is updated.  Deactivated users waiting to be purged and
+// disabled accounts are left alone.
+func getBulkSkipReason(ctx context.Context, id primitive.ObjectID) (string, error) {
+	if deleted, err := services.IsUserDeleted(ctx, id); err != nil {
+		return "", err
+	} else if deleted {
+		return "user deactivated", nil
+	}
+	status, err := services.GetAccountStatus(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if status.Effective(time.Now().UTC()) == services.StatusDisabled {
+		return "account disabled", nil
+	}
+	return "", nil
+}
+
+func hasWorkgroup(user users.User, workgroup string) bool {
+	for _, wg := range user.Workgroups {
+		if strings.EqualFold(wg, workgroup) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+)
+
+func TestBulkUpdateUsers(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	member := addTestUser(t, "member@example.com")
+	outsider := addTestUser(t, "outsider@example.com")
+	deactivated := addTestUser(t, "deactivated@example.com")
+	disabled := addTestUser(t, "disabled@example.com")
+	serve(BulkUpdateUsers, "PUT", BulkUserRequest{Action: "addworkgroup",
+		Value: "scheduler-team", UserIDs: []string{member.ID.Hex(),
+			deactivated.ID.Hex(), disabled.ID.Hex()}})
+	if _, err := services.DeactivateUser(ctx, deactivated.ID.Hex(), "admin"); err != nil {
+		t.Fatalf("DeactivateUser: %s", err.Error())
+	}
+	if err := services.SetAccountStatus(ctx, services.AccountStatus{ID: disabled.ID,
+		Status: services.StatusDisabled}); err != nil {
+		t.Fatalf("SetAccountStatus: %s", err.Error())
+	}
+
+	// the listed users are limited to those in the workgroup
+	w := serve(BulkUpdateUsers, "PUT", BulkUserRequest{
+		Action:    "addworkgroup",
+		Value:     "scheduler-leads",
+		UserIDs:   []string{member.ID.Hex(), outsider.ID.Hex(), deactivated.ID.Hex()},
+		Workgroup: "scheduler-team",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var resp BulkUserResponse
+	decode(t, w, &resp)
+	if len(resp.Results) != 2 || !resp.Results[0].Success ||
+		resp.Results[0].ID != member.ID.Hex() || resp.Results[1].Success ||
+		resp.Results[1].Exception != "Skipped: user deactivated" {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	if !hasWorkgroup(*getTestUser(t, "member@example.com"), "scheduler-leads") {
+		t.Error("workgroup not added to the member")
+	}
+	if hasWorkgroup(*getTestUser(t, "outsider@example.com"), "scheduler-leads") {
+		t.Error("workgroup added to a user outside the workgroup filter")
+	}
+
+	w = serve(BulkUpdateUsers, "PUT", BulkUserRequest{Action: "unlock",
+		Workgroup: "scheduler-team"})
+	resp = BulkUserResponse{}
+	decode(t, w, &resp)
+	if len(resp.Results) != 3 || resp.Results[2].ID != disabled.ID.Hex() ||
+		resp.Results[2].Exception != "Skipped: account disabled" {
+		t.Errorf("results = %+v", resp.Results)
+	}
+
+	// nothing matches every selection
+	w = serve(BulkUpdateUsers, "PUT", BulkUserRequest{Action: "unlock",
+		UserIDs: []string{outsider.ID.Hex()}, Workgroup: "scheduler-team"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status with no users selected = %d, want %d", w.Code,
+			http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ContactPreferenceRequest struct {
+	Channel string `json:"channel" binding:"required"`
+	Webhook string `json:"webhook,omitempty"`
+}
+
+type PhoneRequest struct {
+	Phone string `json:"phone" binding:"required"`
+}
+
+type PhoneConfirmRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type ContactPreferenceResponse struct {
+	Contact   services.ContactPreference `json:"contact"`
+	Exception string                     `json:"exception"`
+}
+
+func GetContactPreference(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, _ := primitive.ObjectIDFromHex(svcs.GetRequestor(c))
+
+	pref, err := services.GetContactPreference(ctx, id)
+	if err != nil {
+		msg := "GetContactPreference Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetContactPreference", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, ContactPreferenceResponse{Contact: *pref, Exception: ""})
+}
+
+func UpdateContactPreference(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data ContactPreferenceRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateContactPreference",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex(svcs.GetRequestor(c))
+	pref, err := services.SetContactPreference(ctx, id, data.Channel, data.Webhook)
+	if err != nil {
+		msg := "UpdateContactPreference Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateContactPreference", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AddLogEntry(c, "authenticate", "UPDATE", "UpdateContactPreference",
+		fmt.Sprintf("Update: channel = %s", pref.Channel))
+	c.JSON(http.StatusOK, ContactPreferenceResponse{Contact: *pref, Exception: ""})
+}
+
+func StartPhoneVerification(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data PhoneRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "StartPhoneVerification",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.GetStores().Users.GetByID(ctx, svcs.GetRequestor(c))
+	if err != nil {
+		msg := "StartPhoneVerification: GetUserByID Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "StartPhoneVerification", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	if err := services.StartPhoneVerification(ctx, *user, data.Phone); err != nil {
+		msg := "StartPhoneVerification Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "StartPhoneVerification", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AddLogEntry(c, "authenticate", "UPDATE", "StartPhoneVerification",
+		fmt.Sprintf("Phone Verification Sent: %s", data.Phone))
+	c.Status(http.StatusOK)
+}
+
+func ConfirmPhone(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data PhoneConfirmRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "ConfirmPhone",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex(svcs.GetRequestor(c))
+	pref, err := services.ConfirmPhone(ctx, id, data.Code)
+	if err != nil {
+		msg := "ConfirmPhone Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "ConfirmPhone", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AddLogEntry(c, "authenticate", "UPDATE", "ConfirmPhone",
+		fmt.Sprintf("Update: phone = %s", pref.Phone))
+	c.JSON(http.StatusOK, ContactPreferenceResponse{Contact: *pref, Exception: ""})
+}
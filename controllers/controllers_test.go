@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+const testPassword = "Correct-Horse-42"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	err := services.LoadSettings([]string{
+		"-mongo.uri=mongodb://localhost",
+		"-security.jwtSecret=test-jwt-secret",
+		"-security.securityKey=test-security-key",
+		"-audit.signingKey=test-audit-signing-key",
+		"-audit.archiveDir=/var/log/authenticate",
+		"-users.inviteUrl=https://auth.example.com/invite",
+		"-users.emailConfirmUrl=https://auth.example.com/email/confirm",
+		"-users.emailRevertUrl=https://auth.example.com/email/revert",
+		"-email.transport=memory",
+		"-email.from=noreply@example.com",
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "settings problem: %s\n", err.Error())
+		os.Exit(2)
+	}
+	os.Exit(m.Run())
+}
+
+// useMemoryStores runs the handlers with empty in-memory stores and no
+// database, providing the transport the queued email is delivered to.
+func useMemoryStores(t *testing.T) *services.MemoryTransport {
+	t.Helper()
+	services.SetStores(services.NewMemoryStores())
+	transport := &services.MemoryTransport{}
+	services.SetMailTransport(transport)
+	t.Cleanup(func() { services.SetMailTransport(nil) })
+	return transport
+}
+
+func addTestUser(t *testing.T, email string) *users.User {
+	t.Helper()
+	user, err := services.GetStores().Users.Create(context.Background(), email,
+		"Test", "", "User", testPassword)
+	if err != nil {
+		t.Fatalf("Create: %s", err.Error())
+	}
+	return user
+}
+
+func getTestUser(t *testing.T, email string) *users.User {
+	t.Helper()
+	user, err := services.GetStores().Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetByEmail: %s", err.Error())
+	}
+	return user
+}
+
+// serve runs the handler for the request with the body sent as JSON.
+func serve(handler gin.HandlerFunc, method string,
+	body interface{}) *httptest.ResponseRecorder {
+	return serveToken(handler, method, "", body)
+}
+
+// serveAs runs the handler for the request made by the logged in user.
+func serveAs(t *testing.T, handler gin.HandlerFunc, method string,
+	user users.User, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := services.GetStores().Sessions.CreateToken(user.ID,
+		user.EmailAddress)
+	if err != nil {
+		t.Fatalf("CreateToken: %s", err.Error())
+	}
+	return serveToken(handler, method, token, body)
+}
+
+func serveToken(handler gin.HandlerFunc, method, token string,
+	body interface{}) *httptest.ResponseRecorder {
+	buf, _ := json.Marshal(body)
+	router := gin.New()
+	router.Handle(method, "/", handler)
+	req := httptest.NewRequest(method, "/", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("response %q: %s", w.Body.String(), err.Error())
+	}
+}
+
+func login(email, passwd string) *httptest.ResponseRecorder {
+	return serve(Login, "POST", users.AuthenticationRequest{
+		EmailAddress: email,
+		Password:     passwd,
+		Application:  "scheduler",
+	})
+}
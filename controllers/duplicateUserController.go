@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+type DuplicateUsersResponse struct {
+	Duplicates []services.DuplicateUsers `json:"duplicates"`
+	Exception  string                    `json:"exception"`
+}
+
+type MergeUsersRequest struct {
+	KeepID   string `json:"keep" binding:"required"`
+	RemoveID string `json:"remove" binding:"required"`
+}
+
+func GetDuplicateUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+	dups, err := services.FindDuplicateUsers(ctx)
+	if err != nil {
+		msg := "GetDuplicateUsers Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", services.CategoryError,
+			"GetDuplicateUsers", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, DuplicateUsersResponse{Duplicates: dups, Exception: ""})
+}
+
+func MergeUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data MergeUsersRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionUserMerge, "",
+			fmt.Sprintf("MergeUsers: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.UserResponse{User: users.User{}, Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.MergeUsers(ctx, data.KeepID, data.RemoveID)
+	if err != nil {
+		msg := "MergeUsers Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionUserMerge, data.RemoveID, msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionUserMerge, services.CategoryUpdate, *user,
+		"", "Users Merged: "+data.RemoveID+" into "+data.KeepID)
+	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
+}
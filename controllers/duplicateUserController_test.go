@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/employees"
+	"github.com/erneap/go-models/users"
+)
+
+func TestMergeUsers(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	keep := addTestUser(t, "keep@example.com")
+	remove := addTestUser(t, "remove@example.com")
+	remove.Workgroups = []string{"scheduler-team"}
+	if err := services.GetStores().Users.Update(ctx, *remove); err != nil {
+		t.Fatalf("Update: %s", err.Error())
+	}
+	if err := services.GetStores().Employees.Insert(ctx,
+		employees.Employee{ID: remove.ID, Email: remove.EmailAddress}); err != nil {
+		t.Fatalf("Insert: %s", err.Error())
+	}
+	if _, err := services.StartEmailChange(ctx, *remove, "pending@example.com"); err != nil {
+		t.Fatalf("StartEmailChange: %s", err.Error())
+	}
+
+	w := serve(GetDuplicateUsers, "GET", nil)
+	var dups DuplicateUsersResponse
+	decode(t, w, &dups)
+	if len(dups.Duplicates) != 1 || dups.Duplicates[0].Reason != "name" ||
+		len(dups.Duplicates[0].Users) != 2 {
+		t.Fatalf("duplicates = %+v", dups.Duplicates)
+	}
+
+	w = serve(MergeUsers, "POST", MergeUsersRequest{KeepID: keep.ID.Hex(),
+		RemoveID: keep.ID.Hex()})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("merge with itself status = %d, want %d", w.Code,
+			http.StatusBadRequest)
+	}
+	w = serve(MergeUsers, "POST", MergeUsersRequest{KeepID: keep.ID.Hex(),
+		RemoveID: remove.ID.Hex()})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var resp users.UserResponse
+	decode(t, w, &resp)
+	if !hasWorkgroup(resp.User, "scheduler-team") {
+		t.Error("removed user's workgroups not added to the kept user")
+	}
+	if _, err := services.GetStores().Users.GetByID(ctx, remove.ID.Hex()); err == nil {
+		t.Error("removed user still kept")
+	}
+	if _, err := services.GetStores().Employees.GetByID(ctx, keep.ID); err != nil {
+		t.Errorf("employee record not moved to the kept user: %s", err.Error())
+	}
+	if inUse, _ := services.IsEmailInUse(ctx, "pending@example.com",
+		keep.ID); inUse {
+		t.Error("removed user's pending email change kept")
+	}
+}
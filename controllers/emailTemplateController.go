@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+type EmailPreviewRequest struct {
+	Name        string                 `json:"name" binding:"required"`
+	Application string                 `json:"application"`
+	Data        map[string]interface{} `json:"data"`
+}
+
+type EmailPreviewResponse struct {
+	Message   services.EmailMessage `json:"message"`
+	Exception string                `json:"exception"`
+}
+
+type EmailTemplateNamesResponse struct {
+	Names     []string `json:"names"`
+	Exception string   `json:"exception"`
+}
+
+func GetEmailTemplateNames(c *gin.Context) {
+	c.JSON(http.StatusOK, EmailTemplateNamesResponse{
+		Names:     services.EmailTemplateNames,
+		Exception: "",
+	})
+}
+
+// PreviewEmailTemplate renders a message with the sample data given, so admins
+// can check a template override before it's used.
+func PreviewEmailTemplate(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data EmailPreviewRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "PreviewEmailTemplate",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	msg, err := services.RenderEmail(ctx, data.Name, data.Application, data.Data)
+	if err != nil {
+		msg := "PreviewEmailTemplate Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "PreviewEmailTemplate", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, EmailPreviewResponse{Message: *msg, Exception: ""})
+}
+
+func UpdateEmailTemplate(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data services.EmailTemplate
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateEmailTemplate",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	if err := services.SaveEmailTemplate(ctx, data); err != nil {
+		msg := "UpdateEmailTemplate Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateEmailTemplate", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AddLogEntry(c, "authenticate", "UPDATE", "UpdateEmailTemplate",
+		fmt.Sprintf("Email Template: %s/%s", data.Application, data.Name))
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/erneap/authentication/services"
+	"github.com/gin-gonic/gin"
+)
+
+// Healthz reports that the process is alive and serving requests.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": services.HealthOK})
+}
+
+// Readyz reports whether the service's dependencies are usable, with the
+// result of each check.  Any failed required check makes the service unready.
+func Readyz(c *gin.Context) {
+	report := services.CheckReadiness(c.Request.Context())
+	status := http.StatusOK
+	if report.Status == services.HealthFail {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+type AcceptInvitationRequest struct {
+	Token       string `json:"token" binding:"required"`
+	Password    string `json:"password" binding:"required"`
+	Application string `json:"application"`
+}
+
+type InvitationResponse struct {
+	Invitation services.Invitation `json:"invitation"`
+	Exception  string              `json:"exception"`
+}
+
+func AcceptInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data AcceptInvitationRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionInviteAccept, "",
+			fmt.Sprintf("AcceptInvitation: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.AuthenticationResponse{Token: "", Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.AcceptInvitation(ctx, data.Token, data.Password)
+	if err != nil {
+		msg := "AcceptInvitation Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionInviteAccept, "", msg)
+		c.JSON(http.StatusBadRequest,
+			users.AuthenticationResponse{Token: "", Exception: msg})
+		return
+	}
+
+	tokenstring, err := createToken(ctx, user.ID, user.EmailAddress)
+	if err != nil {
+		msg := "AcceptInvitation: CreateToken Problem: " + err.Error()
+		services.AuditUser(c, services.ActionInviteAccept, services.CategoryError,
+			*user, data.Application, msg)
+		c.JSON(http.StatusNotFound,
+			users.AuthenticationResponse{Token: "", Exception: msg})
+		return
+	}
+
+	msg := fmt.Sprintf("Invitation Accepted: %s logged into %s at %s",
+		user.GetLastFirst(), data.Application, time.Now().Format("01/02/06 15:04"))
+	services.AuditUser(c, services.ActionInviteAccept, services.CategorySuccess,
+		*user, data.Application, msg)
+
+	c.JSON(http.StatusOK, users.AuthenticationResponse{
+		Token:     tokenstring,
+		User:      *user,
+		Exception: "",
+	})
+}
+
+func ResendInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("userid")
+
+	invite, err := services.ResendInvitation(ctx, id, svcs.GetRequestor(c))
+	if err != nil {
+		msg := "ResendInvitation Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionInviteSend, id, msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.Audit(c, services.AuditEvent{
+		Action:      services.ActionInviteSend,
+		Category:    services.CategoryUpdate,
+		TargetID:    id,
+		TargetEmail: invite.EmailAddress,
+		Message:     "Invitation Resent",
+	})
+	c.JSON(http.StatusOK, InvitationResponse{Invitation: *invite, Exception: ""})
+}
+
+func RevokeInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("userid")
+
+	if err := services.RevokeInvitation(ctx, id); err != nil {
+		msg := "RevokeInvitation Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionInviteRevoke, id, msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.Audit(c, services.AuditEvent{
+		Action:   services.ActionInviteRevoke,
+		Category: services.CategoryDelete,
+		TargetID: id,
+		Message:  "Invitation Revoked",
+	})
+	c.Status(http.StatusOK)
+}
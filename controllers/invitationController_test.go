@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+)
+
+var inviteLink = regexp.MustCompile(`invite\?token=(\S+)`)
+
+func TestAcceptInvitation(t *testing.T) {
+	transport := useMemoryStores(t)
+	ctx := context.Background()
+	user := addTestUser(t, "invited@example.com")
+	if _, err := services.InviteUser(ctx, *user, "scheduler", "admin"); err != nil {
+		t.Fatalf("InviteUser: %s", err.Error())
+	}
+	if w := login("invited@example.com", testPassword); w.Code != http.StatusUnauthorized {
+		t.Errorf("pending login status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if _, err := services.ProcessOutbox(ctx); err != nil {
+		t.Fatalf("ProcessOutbox: %s", err.Error())
+	}
+	sent := transport.Messages()
+	if len(sent) != 1 {
+		t.Fatalf("%d messages sent, want 1", len(sent))
+	}
+	match := inviteLink.FindStringSubmatch(sent[0].Message.Text)
+	if match == nil {
+		t.Fatalf("no invitation link in %q", sent[0].Message.Text)
+	}
+
+	accept := AcceptInvitationRequest{
+		Token:       match[1],
+		Password:    "short",
+		Application: "scheduler",
+	}
+	if w := serve(AcceptInvitation, "POST", accept); w.Code != http.StatusBadRequest {
+		t.Errorf("weak password status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	accept.Password = "Battery-Staple-7"
+	w := serve(AcceptInvitation, "POST", accept)
+	if w.Code != http.StatusOK {
+		t.Fatalf("accept status = %d, want %d: %s", w.Code, http.StatusOK,
+			w.Body.String())
+	}
+	var resp users.AuthenticationResponse
+	decode(t, w, &resp)
+	if resp.Token == "" {
+		t.Error("no token given on acceptance")
+	}
+	status, err := services.GetAccountStatus(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetAccountStatus: %s", err.Error())
+	}
+	if status.Status != services.StatusActive {
+		t.Errorf("status = %q, want %q", status.Status, services.StatusActive)
+	}
+	if w := login("invited@example.com", "Battery-Staple-7"); w.Code != http.StatusOK {
+		t.Errorf("login status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if w := serve(AcceptInvitation, "POST", accept); w.Code != http.StatusBadRequest {
+		t.Errorf("second accept status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAcceptInvitationBadToken(t *testing.T) {
+	useMemoryStores(t)
+	w := serve(AcceptInvitation, "POST", AcceptInvitationRequest{
+		Token:    "bm90LmEudG9rZW4.c2lnbmF0dXJl",
+		Password: "Battery-Staple-7",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
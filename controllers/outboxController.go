@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+type OutboxResponse struct {
+	Messages  []services.OutboxMessage `json:"messages"`
+	Exception string                   `json:"exception"`
+}
+
+// GetOutbox provides the delivery status of queued email messages, optionally
+// filtered by the status query parameter.
+func GetOutbox(c *gin.Context) {
+	ctx := c.Request.Context()
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", "100"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	msgs, err := services.GetOutboxMessages(ctx, c.Query("status"), limit)
+	if err != nil {
+		msg := "GetOutbox Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetOutbox", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, OutboxResponse{Messages: msgs, Exception: ""})
+}
+
+func RetryOutboxMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	if err := services.RetryOutboxMessage(ctx, id); err != nil {
+		msg := "RetryOutboxMessage Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "RetryOutboxMessage", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	services.AddLogEntry(c, "authenticate", "UPDATE", "RetryOutboxMessage",
+		fmt.Sprintf("Outbox Message Requeued: %s", id))
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+// The profile handlers work on the logged in user's own record, identified
+// from the requestor of the token, so they need no admin workgroup.
+
+type ProfileNameRequest struct {
+	FirstName  string `json:"firstName" binding:"required"`
+	MiddleName string `json:"middleName"`
+	LastName   string `json:"lastName" binding:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required"`
+}
+
+type EmailChangeRequest struct {
+	EmailAddress string `json:"emailAddress" binding:"required"`
+}
+
+type EmailConfirmRequest struct {
+	ID   string `json:"id"`
+	Code string `json:"code" binding:"required"`
+}
+
+type EmailRevertRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+func GetProfile(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := services.GetStores().Users.GetByID(ctx, svcs.GetRequestor(c))
+	if err != nil {
+		msg := "GetProfile Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", services.CategoryError, "GetProfile", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
+}
+
+func UpdateProfileName(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data ProfileNameRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionUserUpdate, "",
+			fmt.Sprintf("UpdateProfileName: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.UserResponse{User: users.User{}, Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.GetStores().Users.GetByID(ctx, svcs.GetRequestor(c))
+	if err != nil {
+		msg := "UpdateProfileName: GetUserByID Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", services.CategoryError, "UpdateProfileName", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	before := services.CopyUser(*user)
+	user.FirstName = data.FirstName
+	user.MiddleName = data.MiddleName
+	user.LastName = data.LastName
+	if err := services.GetStores().Users.Update(ctx, *user); err != nil {
+		msg := "UpdateProfileName: UpdateUser Problem: " + err.Error()
+		services.AuditUser(c, services.ActionUserUpdate, services.CategoryError, before,
+			"", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionUserUpdate, services.CategoryUpdate, *user,
+		"", "Update: name", services.DiffUsers(before, *user)...)
+	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
+}
+
+func ChangePassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data ChangePasswordRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionPasswordChange, "",
+			fmt.Sprintf("ChangePassword: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.GetStores().Users.GetByID(ctx, svcs.GetRequestor(c))
+	if err != nil {
+		msg := "ChangePassword: GetUserByID Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", services.CategoryError, "ChangePassword", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	// a failed check counts against the account the same as a failed login
+	if services.IsLockedOut(*user) {
+		services.AuditUser(c, services.ActionPasswordChange,
+			services.CategoryUnauthorized, *user, "", "Account Locked")
+		c.JSON(http.StatusUnauthorized, users.ExceptionResponse{Exception: "account locked"})
+		return
+	}
+	before := user.BadAttempts
+	if err := services.VerifyPassword(ctx, user, data.CurrentPassword); err != nil {
+		services.GetStores().Users.Update(ctx, *user)
+		services.AuditUser(c, services.ActionPasswordChange,
+			services.CategoryUnauthorized, *user, "", "Password Mismatch")
+		services.CheckLockout(ctx, *user, before, "", c.ClientIP(), c.Request.UserAgent())
+		c.JSON(http.StatusUnauthorized, users.ExceptionResponse{Exception: err.Error()})
+		return
+	}
+
+	if err := services.ValidatePassword(data.NewPassword); err != nil {
+		msg := "ChangePassword: " + err.Error()
+		services.AuditUser(c, services.ActionPasswordChange, services.CategoryError,
+			*user, "", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.SetUserPassword(ctx, user, data.NewPassword)
+	user.ResetToken = ""
+	user.ResetTokenExp = nil
+	user.BadAttempts = 0
+	if err := services.GetStores().Users.Update(ctx, *user); err != nil {
+		msg := "ChangePassword: UpdateUser Problem: " + err.Error()
+		services.AuditUser(c, services.ActionPasswordChange, services.CategoryError,
+			*user, "", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionPasswordChange, services.CategoryUpdate,
+		*user, "", "Update: password", services.NewChange("password", "", "changed"))
+	raiseSecurityAlert(c, services.AlertPasswordChange, *user, "",
+		"Your password was changed.")
+	c.Status(http.StatusOK)
+}
+
+func StartEmailChange(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data EmailChangeRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionEmailChange, "",
+			fmt.Sprintf("StartEmailChange: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.GetStores().Users.GetByID(ctx, svcs.GetRequestor(c))
+	if err != nil {
+		msg := "StartEmailChange: GetUserByID Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", services.CategoryError, "StartEmailChange", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	if _, err := services.StartEmailChange(ctx, *user, data.EmailAddress); err != nil {
+		msg := "StartEmailChange Problem: " + err.Error()
+		services.AuditUser(c, services.ActionEmailChange, services.CategoryError,
+			*user, "", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionEmailChange, services.CategoryUpdate, *user,
+		"", "Email Change Requested",
+		services.NewChange("pendingEmailAddress", "", data.EmailAddress))
+	c.Status(http.StatusOK)
+}
+
+func ConfirmEmailChange(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data EmailConfirmRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionEmailChange, "",
+			fmt.Sprintf("ConfirmEmailChange: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	// the logged in user confirms their own change, otherwise the link sent
+	// to the new address provides the user's id.
+	id := data.ID
+	if id == "" {
+		id = svcs.GetRequestor(c)
+	}
+	user, err := services.GetStores().Users.GetByID(ctx, id)
+	if err != nil {
+		msg := "ConfirmEmailChange: GetUserByID Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionEmailChange, id, msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	oldEmail := user.EmailAddress
+	confirmed, err := services.ConfirmEmailChange(ctx, user.ID, data.Code)
+	if err != nil {
+		msg := "ConfirmEmailChange Problem: " + err.Error()
+		services.AuditUser(c, services.ActionEmailChange, services.CategoryError,
+			*user, "", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	user = confirmed
+
+	services.AuditUser(c, services.ActionEmailChange, services.CategoryUpdate, *user,
+		"", "Email Change Confirmed",
+		services.NewChange("emailAddress", oldEmail, user.EmailAddress))
+	raiseSecurityAlert(c, services.AlertEmailChange, *user, "",
+		fmt.Sprintf("Your account's email address was changed to %s.",
+			user.EmailAddress))
+	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
+}
+
+func RevertEmailChange(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data EmailRevertRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AuditFailure(c, services.ActionEmailChange, "",
+			fmt.Sprintf("RevertEmailChange: Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.RevertEmailChange(ctx, data.Token)
+	if err != nil {
+		msg := "RevertEmailChange Problem: " + err.Error()
+		services.AuditFailure(c, services.ActionEmailChange, "", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionEmailChange, services.CategoryUpdate, *user,
+		"", "Email Change Reverted")
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+)
+
+var (
+	confirmCode = regexp.MustCompile(`confirm\?id=\w+&code=(\d+)`)
+	revertLink  = regexp.MustCompile(`revert\?token=(\S+)`)
+)
+
+func TestProfile(t *testing.T) {
+	useMemoryStores(t)
+	user := addTestUser(t, "profile@example.com")
+
+	if w := serve(GetProfile, "GET", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status without a login = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	w := serveAs(t, GetProfile, "GET", *user, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var resp users.UserResponse
+	decode(t, w, &resp)
+	if resp.User.ID != user.ID {
+		t.Errorf("profile of %s, want %s", resp.User.ID.Hex(), user.ID.Hex())
+	}
+
+	w = serveAs(t, UpdateProfileName, "PUT", *user, ProfileNameRequest{
+		FirstName: "Pat", MiddleName: "Q", LastName: "Smith"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("name status = %d: %s", w.Code, w.Body.String())
+	}
+	updated := getTestUser(t, "profile@example.com")
+	if updated.FirstName != "Pat" || updated.MiddleName != "Q" ||
+		updated.LastName != "Smith" {
+		t.Errorf("name = %s %s %s", updated.FirstName, updated.MiddleName,
+			updated.LastName)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	useMemoryStores(t)
+	user := addTestUser(t, "password@example.com")
+
+	w := serveAs(t, ChangePassword, "PUT", *user, ChangePasswordRequest{
+		CurrentPassword: "Wrong-Horse-42", NewPassword: "Battery-Staple-7"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password status = %d, want %d", w.Code,
+			http.StatusUnauthorized)
+	}
+	w = serveAs(t, ChangePassword, "PUT", *user, ChangePasswordRequest{
+		CurrentPassword: testPassword, NewPassword: "short"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("weak password status = %d, want %d", w.Code,
+			http.StatusBadRequest)
+	}
+
+	w = serveAs(t, ChangePassword, "PUT", *user, ChangePasswordRequest{
+		CurrentPassword: testPassword, NewPassword: "Battery-Staple-7"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := login("password@example.com", testPassword); w.Code != http.StatusUnauthorized {
+		t.Errorf("old password login status = %d, want %d", w.Code,
+			http.StatusUnauthorized)
+	}
+	if w := login("password@example.com", "Battery-Staple-7"); w.Code != http.StatusOK {
+		t.Errorf("new password login status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// sentTo provides the text of the last message delivered to the address.
+func sentTo(t *testing.T, transport *services.MemoryTransport, email string) string {
+	t.Helper()
+	if _, err := services.ProcessOutbox(context.Background()); err != nil {
+		t.Fatalf("ProcessOutbox: %s", err.Error())
+	}
+	text := ""
+	for _, sent := range transport.Messages() {
+		for _, to := range sent.To {
+			if strings.EqualFold(to, email) {
+				text = sent.Message.Text
+			}
+		}
+	}
+	if text == "" {
+		t.Fatalf("no message sent to %s", email)
+	}
+	return text
+}
+
+func TestEmailChange(t *testing.T) {
+	transport := useMemoryStores(t)
+	user := addTestUser(t, "old@example.com")
+	addTestUser(t, "taken@example.com")
+
+	w := serveAs(t, StartEmailChange, "POST", *user,
+		EmailChangeRequest{EmailAddress: "Taken@example.com"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("address in use status = %d, want %d", w.Code,
+			http.StatusBadRequest)
+	}
+	w = serveAs(t, StartEmailChange, "POST", *user,
+		EmailChangeRequest{EmailAddress: "new@example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("start status = %d: %s", w.Code, w.Body.String())
+	}
+	match := confirmCode.FindStringSubmatch(sentTo(t, transport, "new@example.com"))
+	if match == nil {
+		t.Fatal("no confirmation code sent to the new address")
+	}
+
+	// the pending address can't be taken by another user
+	other := addTestUser(t, "other@example.com")
+	w = serveAs(t, StartEmailChange, "POST", *other,
+		EmailChangeRequest{EmailAddress: "NEW@example.com"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("pending address status = %d, want %d", w.Code,
+			http.StatusBadRequest)
+	}
+
+	code := "000000"
+	if match[1] == code {
+		code = "000001"
+	}
+	w = serveAs(t, ConfirmEmailChange, "POST", *user,
+		EmailConfirmRequest{Code: code})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad code status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w = serve(ConfirmEmailChange, "POST",
+		EmailConfirmRequest{ID: user.ID.Hex(), Code: match[1]})
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm status = %d: %s", w.Code, w.Body.String())
+	}
+	if changed := getTestUser(t, "new@example.com"); changed.ID != user.ID {
+		t.Errorf("new address belongs to %s", changed.ID.Hex())
+	}
+
+	revert := revertLink.FindStringSubmatch(sentTo(t, transport, "old@example.com"))
+	if revert == nil {
+		t.Fatal("no revert link sent to the old address")
+	}
+	w = serve(RevertEmailChange, "POST", EmailRevertRequest{Token: revert[1]})
+	if w.Code != http.StatusOK {
+		t.Fatalf("revert status = %d: %s", w.Code, w.Body.String())
+	}
+	if reverted := getTestUser(t, "old@example.com"); reverted.ID != user.ID {
+		t.Errorf("old address belongs to %s", reverted.ID.Hex())
+	}
+	w = serve(RevertEmailChange, "POST", EmailRevertRequest{Token: revert[1]})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("second revert status = %d, want %d", w.Code,
+			http.StatusBadRequest)
+	}
+}
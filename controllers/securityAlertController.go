@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+)
+
+type AlertSettingsResponse struct {
+	Settings  []services.AlertSetting `json:"settings"`
+	Exception string                  `json:"exception"`
+}
+
+// raiseSecurityAlert raises the security event for the user with the client's
+// IP address and user agent.
+func raiseSecurityAlert(c *gin.Context, alert string, user users.User,
+	application, description string) {
+	ctx := c.Request.Context()
+	services.RaiseSecurityAlert(ctx, services.SecurityEvent{
+		Type:        alert,
+		User:        user,
+		Application: application,
+		IPAddress:   c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		Description: description,
+	})
+}
+
+// alertUserUpdate raises the security events for an admin's change to a user
+// record: grants of an admin workgroup.
+func alertUserUpdate(c *gin.Context, user users.User, field, value string) {
+	switch strings.ToLower(field) {
+	case "addperm", "addworkgroup", "addpermission":
+		if services.IsAdminRole(value) {
+			raiseSecurityAlert(c, services.AlertAdminGrant, user, "",
+				fmt.Sprintf("Your account was granted the %s workgroup.",
+					strings.ToLower(value)))
+		}
+	}
+}
+
+func GetAlertSettings(c *gin.Context) {
+	ctx := c.Request.Context()
+	settings, err := services.GetAlertSettings(ctx)
+	if err != nil {
+		msg := "GetAlertSettings Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "GetAlertSettings", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, AlertSettingsResponse{Settings: settings, Exception: ""})
+}
+
+func UpdateAlertSetting(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data services.AlertSetting
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAlertSetting",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.ExceptionResponse{Exception: "Trouble with request"})
+		return
+	}
+
+	if err := services.UpdateAlertSetting(ctx, data); err != nil {
+		msg := "UpdateAlertSetting Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateAlertSetting", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AddLogEntry(c, "authenticate", "UPDATE", "UpdateAlertSetting",
+		fmt.Sprintf("Alert Setting: %s enabled=%t user=%t admins=%t", data.Event,
+			data.Enabled, data.NotifyUser, data.NotifyAdmins))
+	GetAlertSettings(c)
+}
@@ -0,0 +1,14 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/erneap/authentication/services"
+	"github.com/gin-gonic/gin"
+)
+
+// GetSettings provides the running configuration, with secrets redacted, and
+// where each value came from.
+func GetSettings(c *gin.Context) {
+	c.JSON(http.StatusOK, services.DumpSettings())
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -14,6 +15,15 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+type DeletedUsersResponse struct {
+	Users     []services.DeletedUser `json:"users"`
+	Exception string                 `json:"exception"`
+}
+
+// loginMismatch is the only failure reason given to a caller who hasn't
+// proven the password, so accounts and their states can't be discovered.
+const loginMismatch = "Email Address/Password mismatch"
+
 func Login(c *gin.Context) {
 	var data users.AuthenticationRequest
 
@@ -25,27 +35,62 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	user, err := svcs.GetUserByEMail(data.EmailAddress)
+	ctx := c.Request.Context()
+	lookupCtx, span := services.StartSpan(ctx, "user.lookup")
+	user, err := services.GetStores().Users.GetByEmail(lookupCtx, data.EmailAddress)
+	services.EndSpan(span, err)
 	if err != nil {
-		msg := "Email Address/Password mismatch"
+		services.LoginCount.WithLabelValues(services.LoginUnknownUser,
+			services.MetricApplication(data.Application)).Inc()
 		services.AddLogEntry(c, "authenticate", "ERROR", "Login",
 			fmt.Sprintf("User Not Found: %s", data.EmailAddress))
-		c.JSON(http.StatusNotFound,
+		c.JSON(http.StatusUnauthorized,
 			users.AuthenticationResponse{Token: "",
-				Exception: msg})
+				Exception: loginMismatch})
 		return
 	}
 
-	if err := user.Authenticate(data.Password); err != nil {
-		svcs.UpdateUser(*user)
-		services.AddLogEntry(c, "authenticate", "UNAUTHORIZED", "Login",
-			fmt.Sprintf("Password Mismatch: %s", data.EmailAddress))
+	if services.IsLockedOut(*user) {
+		services.LoginCount.WithLabelValues(services.LoginDenied,
+			services.MetricApplication(data.Application)).Inc()
+		services.AuditUser(c, services.ActionLogin, services.CategoryUnauthorized,
+			*user, data.Application, "Account Locked")
+		c.JSON(http.StatusUnauthorized,
+			users.AuthenticationResponse{Token: "", Exception: loginMismatch})
+		return
+	}
+
+	before := user.BadAttempts
+	if err := services.VerifyPassword(ctx, user, data.Password); err != nil {
+		services.GetStores().Users.Update(ctx, *user)
+		services.LoginCount.WithLabelValues(services.LoginBadPassword,
+			services.MetricApplication(data.Application)).Inc()
+		services.AuditUser(c, services.ActionLogin, services.CategoryUnauthorized,
+			*user, data.Application, "Password Mismatch",
+			services.NewChange("badAttempts", "", fmt.Sprint(user.BadAttempts)))
+		services.CheckLockout(ctx, *user, before, data.Application, c.ClientIP(),
+			c.Request.UserAgent())
+		c.JSON(http.StatusUnauthorized,
+			users.AuthenticationResponse{
+				Token: "", Exception: loginMismatch})
+		return
+	}
+
+	// the account's state is only given once the caller has proven the password
+	if err := services.CheckAccountAccess(ctx, user.ID); err != nil {
+		services.LoginCount.WithLabelValues(services.LoginDenied,
+			services.MetricApplication(data.Application)).Inc()
+		services.AuditUser(c, services.ActionLogin, services.CategoryUnauthorized,
+			*user, data.Application, "Account Access: "+err.Error())
 		c.JSON(http.StatusUnauthorized,
 			users.AuthenticationResponse{
 				Token: "", Exception: err.Error()})
 		return
 	}
-	err = svcs.UpdateUser(*user)
+
+	updateCtx, span := services.StartSpan(ctx, "user.update")
+	err = services.GetStores().Users.Update(updateCtx, *user)
+	services.EndSpan(span, err)
 	if err != nil {
 		services.AddLogEntry(c, "authenticate", "ERROR", "Login",
 			fmt.Sprintf("User Update Problem: %s", err.Error()))
@@ -55,8 +100,30 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// an expired password only gets a token allowing the password change
+	if services.IsPasswordExpired(*user) {
+		changeToken, err := services.CreatePasswordChangeToken(ctx, *user)
+		if err != nil {
+			services.AddLogEntry(c, "authenticate", "ERROR", "Login",
+				fmt.Sprintf("Create Password Change Token Problem: %s", err.Error()))
+			c.JSON(http.StatusNotFound,
+				users.AuthenticationResponse{Token: "",
+					Exception: "Problem Creating Password Change Token"})
+			return
+		}
+		services.LoginCount.WithLabelValues(services.LoginPasswordExpired,
+			services.MetricApplication(data.Application)).Inc()
+		services.AuditUser(c, services.ActionLogin, services.CategoryUnauthorized,
+			*user, data.Application, "Password Expired")
+		c.JSON(http.StatusForbidden, users.AuthenticationResponse{
+			Token:     changeToken,
+			Exception: "password expired, change required",
+		})
+		return
+	}
+
 	// create token
-	tokenstring, err := svcs.CreateToken(user.ID, user.EmailAddress)
+	tokenstring, err := createToken(ctx, user.ID, user.EmailAddress)
 	if err != nil {
 		msg := "CreateToken Problem: " + err.Error()
 		services.AddLogEntry(c, "authenticate", "ERROR", "Login",
@@ -69,7 +136,12 @@ func Login(c *gin.Context) {
 
 	msg := fmt.Sprintf("User Login: %s logged into %s at %s", user.GetLastFirst(),
 		data.Application, time.Now().Format("01/02/06 15:04"))
-	services.AddLogEntry(c, "authenticate", "SUCCESS", "Login", msg)
+	services.LoginCount.WithLabelValues(services.LoginSuccess,
+		services.MetricApplication(data.Application)).Inc()
+	services.AuditUser(c, services.ActionLogin, services.CategorySuccess, *user,
+		data.Application, msg)
+	services.CheckLoginDevice(ctx, *user, data.Application, c.ClientIP(),
+		c.Request.UserAgent())
 
 	c.JSON(http.StatusOK, users.AuthenticationResponse{
 		Token:     tokenstring,
@@ -78,21 +150,46 @@ func Login(c *gin.Context) {
 	})
 }
 
+// createToken provides a login token for the user, traced as part of the
+// request.
+func createToken(ctx context.Context, id primitive.ObjectID,
+	email string) (string, error) {
+	_, span := services.StartSpan(ctx, "token.create")
+	token, err := services.GetStores().Sessions.CreateToken(id, email)
+	services.EndSpan(span, err)
+	return token, err
+}
+
 func RenewToken(c *gin.Context) {
+	ctx := c.Request.Context()
 	tokenString := c.GetHeader("Authorization")
-	claims, err := svcs.ValidateToken(tokenString)
+	claims, err := services.GetStores().Sessions.ValidateToken(tokenString)
 	if err != nil {
+		services.TokenRenewalCount.WithLabelValues("invalid").Inc()
 		services.AddLogEntry(c, "authenticate", "ERROR", "Login",
 			fmt.Sprintf("Renew Token Problem: %s", err.Error()))
 		c.JSON(http.StatusBadRequest, users.AuthenticationResponse{
 			Token:     "",
 			Exception: err.Error(),
 		})
+		return
 	}
 
 	// replace token by passing a new token in the response header
 	id, _ := primitive.ObjectIDFromHex(claims.UserID)
-	tokenString, _ = svcs.CreateToken(id, claims.EmailAddress)
+	if err := services.CheckAccountAccess(ctx, id); err != nil {
+		services.TokenRenewalCount.WithLabelValues("denied").Inc()
+		services.AddLogEntry(c, "authenticate", "UNAUTHORIZED", "Login",
+			fmt.Sprintf("Renew Token Account Access: %s: %s", claims.EmailAddress,
+				err.Error()))
+		c.JSON(http.StatusUnauthorized, users.AuthenticationResponse{
+			Token:     "",
+			Exception: err.Error(),
+		})
+		return
+	}
+	tokenString, _ = createToken(ctx, id, claims.EmailAddress)
+	services.TokenRenewalCount.WithLabelValues("success").Inc()
 
 	c.JSON(http.StatusOK, users.AuthenticationResponse{
 		Token:     tokenString,
@@ -101,11 +198,12 @@ func RenewToken(c *gin.Context) {
 }
 
 func Logout(c *gin.Context) {
+	ctx := c.Request.Context()
 	id := c.Param("userid")
 	app := c.Param("applicaition")
 
-	fmt.Printf("%s/%s logging out\n", id, app)
-	user, err := svcs.GetUserByID(id)
+	services.RequestLogger(c).Debug("logging out", "userid", id, "application", app)
+	user, err := services.GetStores().Users.GetByID(ctx, id)
 	if err != nil {
 		msg := "GetUserByEmail Problem: " + err.Error()
 		services.AddLogEntry(c, "authenticate", "ERROR", "Logout", msg)
@@ -115,11 +213,14 @@ func Logout(c *gin.Context) {
 
 	msg := fmt.Sprintf("User Logout: %s logged out of %s at %s", user.GetLastFirst(),
 		app, time.Now().Format("01/02/06 15:04"))
-	services.AddLogEntry(c, "authenticate", "LOGOUT", "Login", msg)
+	services.LogoutCount.WithLabelValues(services.MetricApplication(app)).Inc()
+	services.AuditUser(c, services.ActionLogout, services.CategoryLogout, *user,
+		app, msg)
 	c.Status(http.StatusOK)
 }
 
 func UpdateUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	var data users.UpdateRequest
 
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -130,7 +231,7 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
-	user, err := svcs.GetUserByID(data.ID)
+	user, err := services.GetStores().Users.GetByID(ctx, data.ID)
 	if err != nil {
 		msg := "GetUserByID Problem: " + err.Error()
 		services.AddLogEntry(c, "authenticate", "DEBUG", "UpdateUser", msg)
@@ -138,19 +239,59 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	// passwords are only set by their users, through a reset, an invitation or
+	// the profile, and email changes aren't made until confirmed from the new
+	// address
 	switch strings.ToLower(data.Field) {
 	case "password":
-		user.SetPassword(data.Value)
-		user.ResetToken = ""
-		user.BadAttempts = 0
+		msg := "UpdateUser: Passwords are changed through a password reset"
+		services.AuditUser(c, services.ActionUserUpdate, services.CategoryError,
+			*user, "", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	case "email", "emailaddress":
+		if _, err := services.StartEmailChange(ctx, *user, data.Value); err != nil {
+			msg := "UpdateUser: StartEmailChange Problem: " + err.Error()
+			services.AuditUser(c, services.ActionEmailChange, services.CategoryError,
+				*user, "", msg)
+			c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+			return
+		}
+		services.AuditUser(c, services.ActionEmailChange, services.CategoryUpdate,
+			*user, "", "Email Change Requested",
+			services.NewChange("pendingEmailAddress", "", data.Value))
+		c.JSON(http.StatusAccepted, users.UserResponse{User: *user, Exception: ""})
+		return
+	}
+
+	before := services.CopyUser(*user)
+	applyUserUpdate(user, data.Field, data.Value)
+
+	err = services.GetStores().Users.Update(ctx, *user)
+	if err != nil {
+		msg := "UpdateUser Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "UpdateUser", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	services.AuditUser(c, services.ActionUserUpdate, services.CategoryUpdate, *user,
+		"", "Update: "+data.Field, services.DiffUsers(before, *user)...)
+	alertUserUpdate(c, *user, data.Field, data.Value)
+	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
+}
+
+// applyUserUpdate changes a single field on the user record, as requested by
+// an UpdateRequest or a bulk request.  The caller is responsible for saving the
+// user record afterwards.
+func applyUserUpdate(user *users.User, field, value string) {
+	switch strings.ToLower(field) {
 	case "first", "firstname":
-		user.FirstName = data.Value
+		user.FirstName = value
 	case "middle", "middlename":
-		user.MiddleName = data.Value
+		user.MiddleName = value
 	case "last", "lastname":
-		user.LastName = data.Value
-	case "email", "emailaddress":
-		user.EmailAddress = data.Value
+		user.LastName = value
 	case "unlock":
 		user.BadAttempts = 0
 	case "5days":
@@ -159,17 +300,17 @@ func UpdateUser(c *gin.Context) {
 	case "addperm", "addworkgroup", "addpermission":
 		found := false
 		for _, perm := range user.Workgroups {
-			if strings.EqualFold(perm, data.Value) {
+			if strings.EqualFold(perm, value) {
 				found = true
 			}
 		}
 		if !found {
-			user.Workgroups = append(user.Workgroups, strings.ToLower(data.Value))
+			user.Workgroups = append(user.Workgroups, strings.ToLower(value))
 		}
 	case "removeworkgroup", "remove", "removeperm", "removepermission":
 		pos := -1
 		for i, perm := range user.Workgroups {
-			if strings.EqualFold(perm, data.Value) {
+			if strings.EqualFold(perm, value) {
 				pos = i
 			}
 		}
@@ -178,26 +319,10 @@ func UpdateUser(c *gin.Context) {
 				user.Workgroups[pos+1:]...)
 		}
 	}
-
-	err = svcs.UpdateUser(*user)
-	if err != nil {
-		msg := "UpdateUser Problem: " + err.Error()
-		services.AddLogEntry(c, "authenticate", "Debug", "UpdateUser", msg)
-		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
-		return
-	}
-
-	if strings.EqualFold(data.Field, "password") {
-		services.AddLogEntry(c, "authenticate", "UPDATE", "UpdateUser",
-			fmt.Sprintf("Update: %s = %s", data.Field, "XXXXXXXX"))
-	} else {
-		services.AddLogEntry(c, "authenticate", "UPDATE", "UpdateUser",
-			fmt.Sprintf("Update: %s = %s", data.Field, data.Value))
-	}
-	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
 }
 
 func AddUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	var data users.AddUserRequest
 
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -208,8 +333,35 @@ func AddUser(c *gin.Context) {
 		return
 	}
 
-	user := svcs.CreateUser(data.EmailAddress, data.FirstName,
-		data.MiddleName, data.LastName, data.Password)
+	inUse, err := services.IsEmailInUse(ctx, data.EmailAddress, primitive.NilObjectID)
+	if err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "AddUser",
+			fmt.Sprintf("IsEmailInUse Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.UserResponse{User: users.User{}, Exception: "Trouble with request"})
+		return
+	}
+	if inUse {
+		services.AddLogEntry(c, "authenticate", "Debug", "AddUser",
+			fmt.Sprintf("Email Address In Use: %s", data.EmailAddress))
+		c.JSON(http.StatusConflict,
+			users.UserResponse{User: users.User{}, Exception: "Email Address In Use"})
+		return
+	}
+
+	// the user sets their own password through the invitation, so the
+	// initial password is unusable.
+	createCtx, span := services.StartSpan(ctx, "user.create")
+	user, err := services.GetStores().Users.Create(createCtx, data.EmailAddress,
+		data.FirstName, data.MiddleName, data.LastName, services.RandomToken(32))
+	services.EndSpan(span, err)
+	if err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "AddUser",
+			fmt.Sprintf("CreateUser Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.UserResponse{User: users.User{}, Exception: "Trouble with request"})
+		return
+	}
 	switch strings.ToLower(data.Application) {
 	case "metrics":
 		user.Workgroups = append(user.Workgroups, "metrics-geoint")
@@ -218,7 +370,7 @@ func AddUser(c *gin.Context) {
 	default:
 		user.Workgroups = append(user.Workgroups, "default-employee")
 	}
-	err := svcs.UpdateUser(*user)
+	err = services.GetStores().Users.Update(ctx, *user)
 	if err != nil {
 		services.AddLogEntry(c, "authenticate", "Debug", "AddUser",
 			fmt.Sprintf("UserUser Problem: %s", err.Error()))
@@ -227,15 +379,35 @@ func AddUser(c *gin.Context) {
 		return
 	}
 
-	services.AddLogEntry(c, "authenticate", "CREATE", "AddUser",
-		fmt.Sprintf("User Created: %s", data.EmailAddress))
+	_, err = services.InviteUser(ctx, *user, data.Application, svcs.GetRequestor(c))
+	if err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "AddUser",
+			fmt.Sprintf("InviteUser Problem: %s", err.Error()))
+		// the user can't be used without the invitation, so isn't kept
+		if rerr := services.RemoveInvitedUser(ctx, user.ID); rerr != nil {
+			services.AddLogEntry(c, "authenticate", "ERROR", "AddUser",
+				fmt.Sprintf("RemoveInvitedUser Problem: %s", rerr.Error()))
+			c.JSON(http.StatusInternalServerError,
+				users.UserResponse{User: *user,
+					Exception: "Problem Sending Invitation, user not removed"})
+			return
+		}
+		c.JSON(http.StatusBadRequest,
+			users.UserResponse{User: users.User{}, Exception: "Problem Sending Invitation"})
+		return
+	}
+
+	services.AuditUser(c, services.ActionUserCreate, services.CategoryCreate, *user,
+		data.Application, "User Created and Invited",
+		services.DiffUsers(users.User{}, *user)...)
 	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
 }
 
 func DeleteUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	id := c.Param("userid")
 
-	err := svcs.DeleteUser(id)
+	deleted, err := services.DeactivateUser(ctx, id, svcs.GetRequestor(c))
 	if err != nil {
 		msg := "DeleteUser Problem: " + err.Error()
 
@@ -243,15 +415,60 @@ func DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
 		return
 	}
-	services.AddLogEntry(c, "authenticate", "DELETE", "DeleteUser",
-		fmt.Sprintf("User Deleted: %s", id))
+	services.Audit(c, services.AuditEvent{
+		Action:      services.ActionUserDelete,
+		Category:    services.CategoryDelete,
+		TargetID:    id,
+		TargetEmail: deleted.EmailAddress,
+		Message:     "User Deactivated",
+	})
 	c.Status(http.StatusOK)
 }
 
+func RestoreUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("userid")
+
+	err := services.RestoreUser(ctx, id)
+	if err != nil {
+		msg := "RestoreUser Problem: " + err.Error()
+
+		services.AddLogEntry(c, "authenticate", "Debug", "RestoreUser", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
+	user, err := services.GetStores().Users.GetByID(ctx, id)
+	if err != nil {
+		msg := "RestoreUser: GetUserByID Problem: " + err.Error()
+
+		services.AddLogEntry(c, "authenticate", "Debug", "RestoreUser", msg)
+		c.JSON(http.StatusNotFound, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	services.AuditUser(c, services.ActionUserRestore, services.CategoryUpdate, *user,
+		"", "User Restored")
+	c.JSON(http.StatusOK, users.UserResponse{User: *user, Exception: ""})
+}
+
+func GetDeletedUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+	deleted, err := services.GetDeletedUsers(ctx)
+	if err != nil {
+		msg := "GetDeletedUsers Problem: " + err.Error()
+
+		services.AddLogEntry(c, "authenticate", "Debug", "GetDeletedUsers", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	c.JSON(http.StatusOK, DeletedUsersResponse{Users: deleted, Exception: ""})
+}
+
 func GetUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	id := c.Param("userid")
 
-	user, err := svcs.GetUserByID(id)
+	user, err := services.GetStores().Users.GetByID(ctx, id)
 	if err != nil {
 		msg := "GetUser Problem: " + err.Error()
 
@@ -263,8 +480,9 @@ func GetUser(c *gin.Context) {
 }
 
 func GetUsers(c *gin.Context) {
+	ctx := c.Request.Context()
 
-	usrs, err := svcs.GetUsers()
+	usrs, err := services.GetStores().Users.GetAll(ctx)
 	if err != nil {
 		msg := "GetUsers Problem: " + err.Error()
 
@@ -272,10 +490,31 @@ func GetUsers(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
 		return
 	}
-	c.JSON(http.StatusOK, users.UsersResponse{Users: usrs, Exception: ""})
+
+	// deactivated users are only listed through GetDeletedUsers
+	deleted, err := services.GetDeletedUsers(ctx)
+	if err != nil {
+		msg := "GetUsers: GetDeletedUsers Problem: " + err.Error()
+
+		services.AddLogEntry(c, "authenticate", "Debug", "GetUsers", msg)
+		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
+		return
+	}
+	isDeleted := make(map[primitive.ObjectID]bool)
+	for _, du := range deleted {
+		isDeleted[du.ID] = true
+	}
+	var active []users.User
+	for _, user := range usrs {
+		if !isDeleted[user.ID] {
+			active = append(active, user)
+		}
+	}
+	c.JSON(http.StatusOK, users.UsersResponse{Users: active, Exception: ""})
 }
 
 func StartPasswordReset(c *gin.Context) {
+	ctx := c.Request.Context()
 	var data users.AuthenticationRequest
 
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -286,10 +525,26 @@ func StartPasswordReset(c *gin.Context) {
 		return
 	}
 
-	user, err := svcs.GetUserByEMail(data.EmailAddress)
+	user, err := services.GetStores().Users.GetByEmail(ctx, data.EmailAddress)
 	if err != nil {
 		msg := "GetUserByEmail Problem: " + err.Error()
 
+		services.ResetRequestCount.WithLabelValues("unknown_user").Inc()
+		services.AddLogEntry(c, "authenticate", "Debug", "StartPasswordReset", msg)
+		c.JSON(http.StatusNotFound,
+			users.ExceptionResponse{
+				Exception: "No User for Email Address"})
+		return
+	}
+
+	// a deactivated user is answered as though unknown
+	if deleted, err := services.IsUserDeleted(ctx, user.ID); deleted {
+		msg := "User Deactivated: " + data.EmailAddress
+		if err != nil {
+			msg = "IsUserDeleted Problem: " + err.Error()
+		}
+
+		services.ResetRequestCount.WithLabelValues("unknown_user").Inc()
 		services.AddLogEntry(c, "authenticate", "Debug", "StartPasswordReset", msg)
 		c.JSON(http.StatusNotFound,
 			users.ExceptionResponse{
@@ -301,12 +556,12 @@ func StartPasswordReset(c *gin.Context) {
 	nToken := rand.Intn(999999)
 	sToken := fmt.Sprintf("%06d", nToken)
 
-	exp := time.Now().UTC().Add(time.Minute * time.Duration(30))
+	exp := time.Now().UTC().Add(time.Minute * time.Duration(services.GetSettings().Security.ResetExpiryMinutes))
 
 	user.ResetToken = sToken
 	user.ResetTokenExp = &exp
 
-	err = svcs.UpdateUser(*user)
+	err = services.GetStores().Users.Update(ctx, *user)
 	if err != nil {
 		services.AddLogEntry(c, "authenticate", "Debug", "StartPasswordReset",
 			fmt.Sprintf("StartPasswordReset: UpdateUser: %s", err.Error()))
@@ -316,28 +571,26 @@ func StartPasswordReset(c *gin.Context) {
 		return
 	}
 
-	message := "<html><body><h3>You've been redirected to a reset password page.  Please use " +
-		"the following verification token in the appropriate input field, " +
-		" along with a new password/verified to allow you to access this " +
-		"website again!</h3><br/><h2>" + sToken + "</h2></body></html>"
-
-	to := []string{
-		user.EmailAddress,
-	}
-
-	subject := "Reset Password Token"
-
-	err = svcs.SendMail(to, subject, message)
+	// the token goes by the user's chosen channel, since field personnel may
+	// not be able to reach their email when locked out.
+	err = services.NotifyUser(ctx, *user, "reset", data.Application,
+		map[string]interface{}{
+			"Token":   sToken,
+			"Expires": exp.Format("01/02/06 15:04") + " UTC",
+		})
 	if err != nil {
-		msg := "StartPasswordReset: SendMail: " + err.Error()
+		msg := "StartPasswordReset: NotifyUser: " + err.Error()
+		services.ResetRequestCount.WithLabelValues("error").Inc()
 		services.AddLogEntry(c, "authenticate", "Debug", "StartPasswordReset", msg)
 		c.JSON(http.StatusBadRequest, users.ExceptionResponse{Exception: msg})
 		return
 	}
+	services.ResetRequestCount.WithLabelValues("sent").Inc()
 	c.Status(http.StatusOK)
 }
 
 func PasswordReset(c *gin.Context) {
+	ctx := c.Request.Context()
 	var data users.PasswordResetRequest
 
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -349,7 +602,7 @@ func PasswordReset(c *gin.Context) {
 		return
 	}
 
-	user, err := svcs.GetUserByEMail(data.EmailAddress)
+	user, err := services.GetStores().Users.GetByEmail(ctx, data.EmailAddress)
 	if err != nil {
 		msg := "PasswordReset: GetUserByEmail Problem: " + err.Error()
 		services.AddLogEntry(c, "authenticate", "Debug", "PasswordReset", msg)
@@ -358,6 +611,14 @@ func PasswordReset(c *gin.Context) {
 		return
 	}
 
+	if err := services.CheckAccountAccess(ctx, user.ID); err != nil {
+		msg := "PasswordReset: Account Access: " + err.Error()
+		services.AuditUser(c, services.ActionPasswordReset, services.CategoryUnauthorized,
+			*user, data.Application, msg)
+		c.JSON(http.StatusUnauthorized, users.ExceptionResponse{Exception: msg})
+		return
+	}
+
 	if !strings.EqualFold(user.ResetToken, data.Token) {
 		msg := "PasswordReset: Bad Reset Token"
 		services.AddLogEntry(c, "authenticate", "Debug", "PasswordReset", msg)
@@ -375,9 +636,9 @@ func PasswordReset(c *gin.Context) {
 	user.ResetToken = ""
 	user.ResetTokenExp = nil
 	user.BadAttempts = 0
-	user.SetPassword(data.Password)
+	services.SetUserPassword(ctx, user, data.Password)
 
-	err = svcs.UpdateUser(*user)
+	err = services.GetStores().Users.Update(ctx, *user)
 	if err != nil {
 		services.AddLogEntry(c, "authenticate", "Debug", "PasswordReset",
 			fmt.Sprintf("Update User Problem: %s", err.Error()))
@@ -388,7 +649,7 @@ func PasswordReset(c *gin.Context) {
 	}
 
 	// create token
-	tokenstring, err := svcs.CreateToken(user.ID, user.EmailAddress)
+	tokenstring, err := createToken(ctx, user.ID, user.EmailAddress)
 	if err != nil {
 		msg := "PasswordReset: CreateToken Problem: " + err.Error()
 		services.AddLogEntry(c, "authenticate", "Debug", "PasswordReset", msg)
@@ -399,7 +660,62 @@ func PasswordReset(c *gin.Context) {
 	}
 	msg := fmt.Sprintf("User Login: %s logged into %s at %s", user.GetLastFirst(),
 		data.Application, time.Now().Format("01/02/06 15:04"))
-	services.AddLogEntry(c, "authenticate", "SUCCESS", "PasswordReset", msg)
+	services.AuditUser(c, services.ActionPasswordReset, services.CategorySuccess,
+		*user, data.Application, msg, services.NewChange("password", "", "changed"))
+	raiseSecurityAlert(c, services.AlertPasswordChange, *user, data.Application,
+		"Your password was reset.")
+
+	c.JSON(http.StatusOK, users.AuthenticationResponse{
+		Token:     tokenstring,
+		User:      *user,
+		Exception: "",
+	})
+}
+
+type ExpiredPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	Password    string `json:"password" binding:"required"`
+	Application string `json:"application"`
+}
+
+// ChangeExpiredPassword exchanges the restricted token given by Login for an
+// expired password and a new password for a normal login token.
+func ChangeExpiredPassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	var data ExpiredPasswordRequest
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		services.AddLogEntry(c, "authenticate", "Debug", "ChangeExpiredPassword",
+			fmt.Sprintf("Data Binding Problem: %s", err.Error()))
+		c.JSON(http.StatusBadRequest,
+			users.AuthenticationResponse{
+				Token: "", Exception: "Trouble with request"})
+		return
+	}
+
+	user, err := services.ChangeExpiredPassword(ctx, data.Token, data.Password)
+	if err != nil {
+		msg := "ChangeExpiredPassword Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "ChangeExpiredPassword", msg)
+		c.JSON(http.StatusBadRequest,
+			users.AuthenticationResponse{Token: "", Exception: msg})
+		return
+	}
+
+	tokenstring, err := createToken(ctx, user.ID, user.EmailAddress)
+	if err != nil {
+		msg := "ChangeExpiredPassword: CreateToken Problem: " + err.Error()
+		services.AddLogEntry(c, "authenticate", "Debug", "ChangeExpiredPassword", msg)
+		c.JSON(http.StatusNotFound,
+			users.AuthenticationResponse{Token: "", Exception: msg})
+		return
+	}
+	msg := fmt.Sprintf("User Login: %s changed expired password and logged into %s at %s",
+		user.GetLastFirst(), data.Application, time.Now().Format("01/02/06 15:04"))
+	services.AuditUser(c, services.ActionPasswordChange, services.CategorySuccess,
+		*user, data.Application, msg, services.NewChange("password", "", "changed"))
+	raiseSecurityAlert(c, services.AlertPasswordChange, *user, data.Application,
+		"Your expired password was changed.")
 
 	c.JSON(http.StatusOK, users.AuthenticationResponse{
 		Token:     tokenstring,
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/erneap/authentication/services"
+	"github.com/erneap/go-models/users"
+)
+
+func TestLogin(t *testing.T) {
+	useMemoryStores(t)
+	user := addTestUser(t, "login@example.com")
+
+	w := login("LOGIN@example.com", testPassword)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp users.AuthenticationResponse
+	decode(t, w, &resp)
+	claims, err := services.GetStores().Sessions.ValidateToken(resp.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %s", err.Error())
+	}
+	if claims.UserID != user.ID.Hex() {
+		t.Errorf("token user = %q, want %q", claims.UserID, user.ID.Hex())
+	}
+
+	for _, tc := range []struct {
+		name, email, passwd string
+		code                int
+	}{
+		{"unknown user", "nobody@example.com", testPassword, http.StatusUnauthorized},
+		{"wrong password", "login@example.com", "Wrong-Horse-42", http.StatusUnauthorized},
+	} {
+		w := login(tc.email, tc.passwd)
+		if w.Code != tc.code {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.code)
+		}
+		decode(t, w, &resp)
+		if resp.Exception != loginMismatch || resp.Token != "" {
+			t.Errorf("%s: response = %+v", tc.name, resp)
+		}
+	}
+	if attempts := getTestUser(t, "login@example.com").BadAttempts; attempts != 1 {
+		t.Errorf("bad attempts = %d, want 1", attempts)
+	}
+}
+
+func TestLoginDisabledAccount(t *testing.T) {
+	useMemoryStores(t)
+	user := addTestUser(t, "disabled@example.com")
+	err := services.SetAccountStatus(context.Background(), services.AccountStatus{
+		ID:     user.ID,
+		Status: services.StatusDisabled,
+	})
+	if err != nil {
+		t.Fatalf("SetAccountStatus: %s", err.Error())
+	}
+
+	if w := login("disabled@example.com", testPassword); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	useMemoryStores(t)
+	addTestUser(t, "lockout@example.com")
+
+	attempts := services.GetSettings().Security.LockoutAttempts
+	for i := 0; i < attempts; i++ {
+		login("lockout@example.com", "Wrong-Horse-42")
+	}
+	if !services.IsLockedOut(*getTestUser(t, "lockout@example.com")) {
+		t.Fatalf("not locked out after %d bad attempts", attempts)
+	}
+
+	// the right password no longer logs in, and says no more than a wrong one
+	w := login("lockout@example.com", testPassword)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	var resp users.AuthenticationResponse
+	decode(t, w, &resp)
+	if resp.Exception != loginMismatch || resp.Token != "" {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	useMemoryStores(t)
+	addTestUser(t, "reset@example.com")
+
+	w := serve(StartPasswordReset, "POST", users.AuthenticationRequest{
+		EmailAddress: "reset@example.com",
+		Application:  "scheduler",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("start status = %d, want %d: %s", w.Code, http.StatusOK,
+			w.Body.String())
+	}
+	token := getTestUser(t, "reset@example.com").ResetToken
+	if token == "" {
+		t.Fatal("no reset token set")
+	}
+
+	reset := users.PasswordResetRequest{
+		EmailAddress: "reset@example.com",
+		Token:        "bad",
+		Password:     "Battery-Staple-7",
+		Application:  "scheduler",
+	}
+	if w := serve(PasswordReset, "PUT", reset); w.Code != http.StatusBadRequest {
+		t.Errorf("bad token status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	reset.Token = token
+	w = serve(PasswordReset, "PUT", reset)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset status = %d, want %d: %s", w.Code, http.StatusOK,
+			w.Body.String())
+	}
+	if user := getTestUser(t, "reset@example.com"); user.ResetToken != "" {
+		t.Error("reset token kept after use")
+	}
+	if w := login("reset@example.com", "Battery-Staple-7"); w.Code != http.StatusOK {
+		t.Errorf("login with new password status = %d, want %d", w.Code,
+			http.StatusOK)
+	}
+	if w := serve(PasswordReset, "PUT", reset); w.Code == http.StatusOK {
+		t.Error("reset token used twice")
+	}
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	useMemoryStores(t)
+	user := addTestUser(t, "updated@example.com")
+
+	w := serve(UpdateUser, "PUT", users.UpdateRequest{
+		ID:    user.ID.Hex(),
+		Field: "password",
+		Value: "Admin-Chosen-42",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if login("updated@example.com", "Admin-Chosen-42").Code == http.StatusOK {
+		t.Error("an admin set the user's password")
+	}
+}
@@ -1,24 +1,145 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/erneap/authentication/controllers"
-	"github.com/erneap/go-models/config"
+	"github.com/erneap/authentication/services"
 	"github.com/erneap/go-models/svcs"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	fmt.Println("Starting")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	// stop here rather than at the first request when misconfigured
+	if err := services.LoadSettings(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "configuration problems:\n%s\n", err.Error())
+		os.Exit(2)
+	}
+	services.InitLogging()
+	services.Logger.Info("Starting")
+
+	shutdownTracing, err := services.InitTracing()
+	if err != nil {
+		services.Logger.Error("tracing not started", "error", err)
+	} else {
+		defer shutdownTracing(context.Background())
+	}
 
 	// run database
-	config.ConnectDB()
+	services.ConnectMongo()
+	services.SetStores(services.NewMongoStores())
+
+	// create the indexes, retrying those MongoDB couldn't create yet
+	services.RunPeriodically("EnsureIndexes", 5*time.Minute, services.EnsureIndexes)
+
+	// purge deactivated users after the retention period, as currently set
+	services.RunPeriodically("PurgeDeletedUsers", 24*time.Hour,
+		func(ctx context.Context) error {
+			count, err := services.PurgeDeletedUsers(ctx,
+				services.GetSettings().Users.RetentionDays)
+			if count > 0 {
+				services.Logger.Info("purged deactivated users", "count", count)
+			}
+			return err
+		})
+
+	// disable accounts whose end date has passed
+	services.RunPeriodically("ExpireAccounts", time.Hour,
+		func(ctx context.Context) error {
+			_, err := services.ExpireAccounts(ctx)
+			return err
+		})
+
+	// warn users ahead of their password expiration
+	services.RunPeriodically("SendPasswordExpiryNotices", 24*time.Hour,
+		func(ctx context.Context) error {
+			_, err := services.SendPasswordExpiryNotices(ctx)
+			return err
+		})
+
+	// deliver queued email messages
+	services.RunPeriodically("ProcessOutbox",
+		time.Duration(services.GetSettings().Email.QueueSeconds)*time.Second,
+		func(ctx context.Context) error {
+			_, err := services.ProcessOutbox(ctx)
+			return err
+		})
+
+	// sign the head of the audit chain
+	services.RunPeriodically("CreateAuditCheckpoint",
+		time.Duration(services.GetSettings().Audit.CheckpointMinutes)*time.Minute,
+		func(ctx context.Context) error {
+			_, err := services.CreateAuditCheckpoint(ctx)
+			return err
+		})
+
+	// pick up rotated secrets and settings file changes, also on SIGHUP
+	if seconds := services.GetSettings().Server.SettingsReloadSeconds; seconds > 0 {
+		services.RunPeriodically("ReloadSettings", time.Duration(seconds)*time.Second,
+			func(context.Context) error { return services.ReloadSettings() })
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := services.ReloadSettings(); err != nil {
+				services.Logger.Error("settings not reloaded", "error", err)
+			}
+		}
+	}()
+
+	// roll up and archive audit events past their retention period
+	services.RunPeriodically("ArchiveAuditEvents", 24*time.Hour,
+		func(ctx context.Context) error {
+			count, err := services.ArchiveAuditEvents(ctx)
+			if count > 0 {
+				services.Logger.Info("archived audit events", "count", count)
+			}
+			return err
+		})
 
 	// add routes
-	router := gin.Default()
-	adminRoles := []string{"metrics-admin", "scheduler-scheduler",
-		"scheduler-siteleader", "scheduler-teamleader", "scheduler-admin"}
+	router := gin.New()
+	router.Use(gin.Recovery(), services.RequestID(), services.Tracing(),
+		services.AccessLog(), services.HTTPMetrics(), services.ClientCertificates())
+
+	// metrics are served on their own port when METRICS_ADDR is set, otherwise
+	// on the router behind the METRICS_TOKEN bearer token.
+	var servers []*http.Server
+	if addr := services.GetSettings().Metrics.Addr; addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsServer := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		servers = append(servers, metricsServer)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				services.Logger.Error("metrics listener problem", "error", err)
+			}
+		}()
+	} else if token := services.GetSettings().Metrics.Token; token != "" {
+		router.GET("/metrics", services.MetricsHandler(token))
+	} else {
+		services.Logger.Warn("metrics not served, set METRICS_ADDR or METRICS_TOKEN")
+	}
+	router.GET("/healthz", controllers.Healthz)
+	router.GET("/readyz", controllers.Readyz)
+
+	adminRoles := services.GetSettings().Security.AdminRoles
 	api := router.Group("/authentication/api/v2")
 	{
 		authenticate := api.Group("/authenticate")
@@ -26,6 +147,7 @@ func main() {
 			authenticate.POST("/", controllers.Login)
 			authenticate.PUT("/", svcs.CheckJWT("authentication"),
 				controllers.RenewToken)
+			authenticate.POST("/password", controllers.ChangeExpiredPassword)
 			authenticate.DELETE("/:userid/:application",
 				svcs.CheckJWT("authentication"), controllers.Logout)
 		}
@@ -37,15 +159,108 @@ func main() {
 			user.PUT("/", svcs.CheckRoleList("authentication", adminRoles), controllers.UpdateUser)
 			user.DELETE("/:userid", svcs.CheckRoleList("authentication", adminRoles),
 				controllers.DeleteUser)
+			user.PUT("/bulk", svcs.CheckRoleList("authentication", adminRoles),
+				controllers.BulkUpdateUsers)
+			user.PUT("/:userid/restore", svcs.CheckRoleList("authentication", adminRoles),
+				controllers.RestoreUser)
+			user.GET("/:userid/status", svcs.CheckRoleList("authentication", adminRoles),
+				controllers.GetAccountStatus)
+			user.PUT("/:userid/status", svcs.CheckRoleList("authentication", adminRoles),
+				controllers.UpdateAccountStatus)
 		}
 		reset := api.Group("/reset")
 		{
 			reset.POST("/", controllers.StartPasswordReset)
 			reset.PUT("/", controllers.PasswordReset)
 		}
+		me := api.Group("/me", svcs.CheckJWT("authentication"))
+		{
+			me.GET("/", controllers.GetProfile)
+			me.PUT("/", controllers.UpdateProfileName)
+			me.POST("/password", controllers.ChangePassword)
+			me.POST("/email", controllers.StartEmailChange)
+			me.POST("/email/confirm", controllers.ConfirmEmailChange)
+			me.GET("/contact", controllers.GetContactPreference)
+			me.PUT("/contact", controllers.UpdateContactPreference)
+			me.POST("/phone", controllers.StartPhoneVerification)
+			me.POST("/phone/verify", controllers.ConfirmPhone)
+		}
+		email := api.Group("/email")
+		{
+			email.POST("/confirm", controllers.ConfirmEmailChange)
+			email.POST("/revert", controllers.RevertEmailChange)
+		}
+		invite := api.Group("/invite")
+		{
+			invite.POST("/accept", controllers.AcceptInvitation)
+			invite.PUT("/:userid", svcs.CheckRoleList("authentication", adminRoles),
+				controllers.ResendInvitation)
+			invite.DELETE("/:userid", svcs.CheckRoleList("authentication", adminRoles),
+				controllers.RevokeInvitation)
+		}
+		templates := api.Group("/templates",
+			svcs.CheckRoleList("authentication", adminRoles))
+		{
+			templates.GET("/", controllers.GetEmailTemplateNames)
+			templates.PUT("/", controllers.UpdateEmailTemplate)
+			templates.POST("/preview", controllers.PreviewEmailTemplate)
+		}
+		outbox := api.Group("/outbox", svcs.CheckRoleList("authentication", adminRoles))
+		{
+			outbox.GET("/", controllers.GetOutbox)
+			outbox.PUT("/:id/retry", controllers.RetryOutboxMessage)
+		}
+		alerts := api.Group("/alerts", svcs.CheckRoleList("authentication", adminRoles))
+		{
+			alerts.GET("/", controllers.GetAlertSettings)
+			alerts.PUT("/", controllers.UpdateAlertSetting)
+		}
+		audit := api.Group("/audit", svcs.CheckRoleList("authentication", adminRoles))
+		{
+			audit.GET("/", controllers.GetAuditEvents)
+			audit.GET("/export", controllers.ExportAuditEvents)
+			audit.GET("/user/:userid", controllers.GetUserTimeline)
+			audit.GET("/verify", controllers.VerifyAuditChain)
+			audit.GET("/rollups", controllers.GetAuditRollups)
+		}
+		api.GET("/settings", svcs.CheckRoleList("authentication", adminRoles),
+			controllers.GetSettings)
 		api.GET("/users", svcs.CheckRoleList("authentication", adminRoles), controllers.GetUsers)
+		api.GET("/users/deleted", svcs.CheckRoleList("authentication", adminRoles),
+			controllers.GetDeletedUsers)
+		api.GET("/users/duplicates", svcs.CheckRoleList("authentication", adminRoles),
+			controllers.GetDuplicateUsers)
+		api.POST("/users/merge", svcs.CheckRoleList("authentication", adminRoles),
+			controllers.MergeUsers)
 	}
 
-	// listen on port 6000
-	router.Run(":6000")
+	server := services.NewHTTPServer(router)
+	server.TLSConfig, err = services.NewTLSConfig()
+	if err != nil {
+		services.Logger.Error("TLS not configured", "error", err)
+		os.Exit(1)
+	}
+	servers = append([]*http.Server{server}, servers...)
+	go func() {
+		services.Logger.Info("listening", "addr", server.Addr,
+			"tls", server.TLSConfig != nil)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			services.Logger.Error("listener problem", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// drain requests and flush queues before stopping on SIGTERM or interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM,
+		os.Interrupt)
+	<-ctx.Done()
+	stop()
+	services.Logger.Info("Stopping")
+	services.Shutdown(servers...)
 }
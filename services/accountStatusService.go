@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+	StatusPending  = "pending-activation"
+	StatusExpired  = "expired"
+)
+
+// AccountStatus controls whether a user may log in, separate from password
+// lockouts.  The start and end dates bound the period the account is usable,
+// so temporary contractors and people on extended leave can be set up ahead
+// of time.  A user without an account status record is active.
+type AccountStatus struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Status    string             `json:"status" bson:"status"`
+	Reason    string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	StartDate *time.Time         `json:"startDate,omitempty" bson:"startDate,omitempty"`
+	EndDate   *time.Time         `json:"endDate,omitempty" bson:"endDate,omitempty"`
+	UpdatedBy string             `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+	Updated   time.Time          `json:"updated" bson:"updated"`
+}
+
+// Effective provides the status of the account at the time given, taking the
+// start and end dates into account.
+func (s *AccountStatus) Effective(now time.Time) string {
+	if s.Status != StatusActive {
+		return s.Status
+	}
+	if s.StartDate != nil && now.Before(*s.StartDate) {
+		return StatusPending
+	}
+	if s.EndDate != nil && now.After(*s.EndDate) {
+		return StatusExpired
+	}
+	return StatusActive
+}
+
+func IsValidAccountStatus(status string) bool {
+	switch status {
+	case StatusActive, StatusDisabled, StatusPending, StatusExpired:
+		return true
+	}
+	return false
+}
+
+func getAccountStatusCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "accountstatus")
+}
+
+// GetAccountStatus provides the account status for the user, an active status
+// is provided when none is recorded.
+func GetAccountStatus(ctx context.Context,
+	id primitive.ObjectID) (*AccountStatus, error) {
+	status, err := GetStores().Accounts.GetStatus(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return &AccountStatus{ID: id, Status: StatusActive}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func SetAccountStatus(ctx context.Context, status AccountStatus) error {
+	status.Status = strings.ToLower(status.Status)
+	if !IsValidAccountStatus(status.Status) {
+		return errors.New("invalid account status: " + status.Status)
+	}
+	if status.StartDate != nil && status.EndDate != nil &&
+		status.EndDate.Before(*status.StartDate) {
+		return errors.New("end date before start date")
+	}
+	status.Updated = time.Now().UTC()
+	return GetStores().Accounts.SaveStatus(ctx, status)
+}
+
+// CheckAccountAccess provides an error when the user isn't allowed to log in
+// or renew a token, either because the account was deleted or its status
+// isn't active.
+func CheckAccountAccess(ctx context.Context, id primitive.ObjectID) error {
+	if deleted, err := IsUserDeleted(ctx, id); err != nil {
+		return err
+	} else if deleted {
+		return errors.New("account deactivated")
+	}
+	status, err := GetAccountStatus(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch status.Effective(time.Now().UTC()) {
+	case StatusDisabled:
+		return errors.New("account disabled")
+	case StatusPending:
+		return errors.New("account pending activation")
+	case StatusExpired:
+		return errors.New("account expired")
+	}
+	return nil
+}
+
+// ExpireAccounts marks active accounts whose end date has passed as expired,
+// returning the number of accounts changed.
+func ExpireAccounts(ctx context.Context) (int, error) {
+	return GetStores().Accounts.ExpireStatuses(ctx, time.Now().UTC())
+}
@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The audit trail is a hash chain: each event is numbered and its hash covers
+// the event and the previous event's hash, so a deleted or modified entry
+// breaks the chain.  Checkpoints of the chain's head are signed with
+// AUDIT_SIGNING_KEY, so rewriting the whole chain from a point is detected as
+// well.  Each checkpoint names the key it was signed with, and the keys used
+// before a rotation are kept in AUDIT_SIGNING_KEY_PREVIOUS to verify the older
+// checkpoints.
+
+// AuditCheckpoint is a signed record of the chain's head at a point in time.
+type AuditCheckpoint struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Seq       int64              `json:"seq" bson:"seq"`
+	Hash      string             `json:"hash" bson:"hash"`
+	Time      time.Time          `json:"time" bson:"time"`
+	KeyID     string             `json:"keyId" bson:"keyId"`
+	Signature string             `json:"signature" bson:"signature"`
+}
+
+// AuditProblem is a break in the audit chain found by verification.
+type AuditProblem struct {
+	Seq     int64  `json:"seq"`
+	Problem string `json:"problem"`
+}
+
+// AuditVerification is the result of checking the audit chain.
+type AuditVerification struct {
+	Valid       bool           `json:"valid"`
+	Checked     int64          `json:"checked"`
+	LastSeq     int64          `json:"lastSeq"`
+	Checkpoints int64          `json:"checkpoints"`
+	Problems    []AuditProblem `json:"problems"`
+	Verified    time.Time      `json:"verified"`
+}
+
+// auditChainLock serializes the events written by this instance.  Writers in
+// other instances are caught by the unique sequence index and retried.
+var auditChainLock sync.Mutex
+
+func getAuditCheckpointCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "auditcheckpoints")
+}
+
+// getAuditVerifyKeys provides the signing keys a checkpoint may have been
+// signed with: the current or previous key of its id, or all of them for the
+// checkpoints written before the key id was recorded.
+func getAuditVerifyKeys(id string) [][]byte {
+	audit := GetSettings().Audit
+	var keys [][]byte
+	for _, key := range append([]string{audit.SigningKey}, audit.PreviousSigningKeys...) {
+		if key != "" && (id == "" || secretKeyID(key) == id) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+// ensureAuditChainIndexes creates the unique index on the chain sequence.
+// Events written before the chain have no sequence and are left out.
+func ensureAuditChainIndexes(ctx context.Context) error {
+	_, err := getAuditCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "seq", Value: 1}},
+		Options: options.Index().
+			SetName("seq_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = getAuditCheckpointCollection().Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "seq", Value: -1}}})
+	return err
+}
+
+// computeHash provides the event's hash, covering every field except the hash
+// itself.  The time is in UTC at the database's millisecond precision so the
+// hash is the same once the event is read back.
+func (evt AuditEvent) computeHash() string {
+	evt.Hash = ""
+	evt.Time = evt.Time.UTC().Truncate(time.Millisecond)
+	if len(evt.Changes) == 0 {
+		evt.Changes = nil
+	}
+	buf, _ := json.Marshal(evt)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAuditEvent adds the event to the end of the chain.
+func appendAuditEvent(ctx context.Context, evt AuditEvent) error {
+	auditChainLock.Lock()
+	defer auditChainLock.Unlock()
+
+	for attempt := 0; attempt < 5; attempt++ {
+		last, err := GetStores().Audit.Last(ctx)
+		if err != nil {
+			return err
+		}
+		evt.Seq = 1
+		evt.PrevHash = ""
+		if last != nil {
+			evt.Seq = last.Seq + 1
+			evt.PrevHash = last.Hash
+		}
+		evt.Hash = evt.computeHash()
+
+		if err = GetStores().Audit.Insert(ctx, evt); err != ErrAuditSeqTaken {
+			return err
+		}
+	}
+	return errors.New("audit chain busy, event not written")
+}
+
+func (cp AuditCheckpoint) sign(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d.%s.%d", cp.Seq, cp.Hash, cp.Time.UnixMilli())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CreateAuditCheckpoint signs the current head of the chain.  Nothing is
+// written when the chain hasn't grown since the last checkpoint.
+func CreateAuditCheckpoint(ctx context.Context) (*AuditCheckpoint, error) {
+	key := GetSettings().Audit.SigningKey
+	if key == "" {
+		return nil, errors.New("no audit signing key")
+	}
+	last, err := GetStores().Audit.Last(ctx)
+	if err != nil || last == nil {
+		return nil, err
+	}
+
+	prior, err := GetStores().Audit.LastCheckpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if prior != nil && prior.Seq >= last.Seq {
+		return nil, nil
+	}
+
+	cp := AuditCheckpoint{
+		ID:    primitive.NewObjectID(),
+		Seq:   last.Seq,
+		Hash:  last.Hash,
+		Time:  time.Now().UTC().Truncate(time.Millisecond),
+		KeyID: secretKeyID(key),
+	}
+	cp.Signature = cp.sign([]byte(key))
+	if err := GetStores().Audit.InsertCheckpoint(ctx, cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// VerifyAuditChain walks the chain in order, checking every event's hash and
+// link to the one before it, and then checks each signed checkpoint against
+// the chain.
+func VerifyAuditChain(ctx context.Context) (*AuditVerification, error) {
+	result := &AuditVerification{
+		Problems: []AuditProblem{},
+		Verified: time.Now().UTC(),
+	}
+	problem := func(seq int64, format string, args ...interface{}) {
+		result.Problems = append(result.Problems, AuditProblem{
+			Seq:     seq,
+			Problem: fmt.Sprintf(format, args...),
+		})
+	}
+
+	archived, err := getArchivedLinks(ctx, problem)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[int64]string)
+	var prev *AuditEvent
+	err = GetStores().Audit.Walk(ctx, func(evt AuditEvent) error {
+		result.Checked++
+
+		if evt.computeHash() != evt.Hash {
+			problem(evt.Seq, "entry modified")
+		}
+		expected := int64(1)
+		prevHash := ""
+		if prev != nil {
+			expected = prev.Seq + 1
+			prevHash = prev.Hash
+		}
+		for ; expected < evt.Seq; expected++ {
+			link, ok := archived[expected]
+			if !ok {
+				problem(expected, "entry missing")
+				prevHash = ""
+				continue
+			}
+			if prevHash != "" && link.PrevHash != prevHash {
+				problem(expected, "archived entry doesn't follow the previous entry")
+			}
+			hashes[expected] = link.Hash
+			prevHash = link.Hash
+		}
+		if prevHash != "" && evt.PrevHash != prevHash {
+			problem(evt.Seq, "previous entry modified or replaced")
+		}
+		hashes[evt.Seq] = evt.Hash
+		result.LastSeq = evt.Seq
+		prev = &evt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for link, ok := archived[result.LastSeq+1]; ok; link, ok = archived[result.LastSeq+1] {
+		hashes[link.Seq] = link.Hash
+		result.LastSeq = link.Seq
+	}
+
+	checkpoints, err := GetStores().Audit.Checkpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range checkpoints {
+		result.Checkpoints++
+		keys := getAuditVerifyKeys(cp.KeyID)
+		if len(keys) == 0 {
+			problem(cp.Seq, "checkpoint signed with an unknown key")
+			continue
+		}
+		signed := false
+		for _, key := range keys {
+			signed = signed || hmac.Equal([]byte(cp.sign(key)), []byte(cp.Signature))
+		}
+		if !signed {
+			problem(cp.Seq, "checkpoint signature invalid")
+			continue
+		}
+		if cp.Seq > result.LastSeq {
+			problem(cp.Seq, "entries after %d deleted", result.LastSeq)
+		} else if hash, ok := hashes[cp.Seq]; ok && hash != cp.Hash {
+			problem(cp.Seq, "chain rewritten since checkpoint")
+		}
+	}
+
+	result.Valid = len(result.Problems) == 0
+	return result, nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeHash(t *testing.T) {
+	evt := AuditEvent{
+		Seq:      1,
+		Time:     time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC),
+		Action:   ActionLogin,
+		Category: CategorySuccess,
+		Changes:  []AuditChange{},
+	}
+	hash := evt.computeHash()
+
+	// as read back from the database, at millisecond precision with its hash
+	stored := evt
+	stored.Time = evt.Time.Truncate(time.Millisecond).In(time.FixedZone("EST", -5*3600))
+	stored.Changes = nil
+	stored.Hash = hash
+	if stored.computeHash() != hash {
+		t.Error("hash changed once stored")
+	}
+
+	changed := evt
+	changed.Message = "edited"
+	if changed.computeHash() == hash {
+		t.Error("hash doesn't cover the message")
+	}
+	relinked := evt
+	relinked.PrevHash = "other"
+	if relinked.computeHash() == hash {
+		t.Error("hash doesn't cover the link to the previous entry")
+	}
+}
+
+// writeTestChain provides fresh in-memory stores holding a chain of the
+// number of events given.
+func writeTestChain(t *testing.T, count int) *MemoryAuditStore {
+	t.Helper()
+	SetStores(NewMemoryStores())
+	for i := 0; i < count; i++ {
+		if err := Audit(nil, AuditEvent{Action: ActionLogin,
+			Category: CategorySuccess}); err != nil {
+			t.Fatalf("Audit: %s", err.Error())
+		}
+	}
+	return GetStores().Audit.(*MemoryAuditStore)
+}
+
+func TestAuditChain(t *testing.T) {
+	ctx := context.Background()
+	store := writeTestChain(t, 3)
+	for i, evt := range store.events {
+		if evt.Seq != int64(i+1) {
+			t.Errorf("event %d has sequence %d", i, evt.Seq)
+		}
+		if i > 0 && evt.PrevHash != store.events[i-1].Hash {
+			t.Errorf("event %d doesn't link to the one before", i)
+		}
+	}
+	if _, err := CreateAuditCheckpoint(ctx); err != nil {
+		t.Fatalf("CreateAuditCheckpoint: %s", err.Error())
+	}
+	if cp, _ := CreateAuditCheckpoint(ctx); cp != nil {
+		t.Error("checkpoint written without new events")
+	}
+
+	result, err := VerifyAuditChain(ctx)
+	if err != nil {
+		t.Fatalf("VerifyAuditChain: %s", err.Error())
+	}
+	if !result.Valid || result.Checked != 3 || result.Checkpoints != 1 {
+		t.Errorf("intact chain = %+v", result)
+	}
+}
+
+func TestVerifyAuditChainTampered(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		tamper func(store *MemoryAuditStore)
+		want   string
+	}{
+		{"modified", func(store *MemoryAuditStore) {
+			store.events[1].Message = "edited"
+		}, "entry modified"},
+		{"removed", func(store *MemoryAuditStore) {
+			store.events = append(store.events[:1], store.events[2:]...)
+		}, "entry missing"},
+		{"head deleted", func(store *MemoryAuditStore) {
+			store.events = store.events[:2]
+		}, "entries after 2 deleted"},
+		{"checkpoint forged", func(store *MemoryAuditStore) {
+			store.checkpoints[0].Hash = "forged"
+		}, "checkpoint signature invalid"},
+	} {
+		store := writeTestChain(t, 3)
+		if _, err := CreateAuditCheckpoint(ctx); err != nil {
+			t.Fatalf("CreateAuditCheckpoint: %s", err.Error())
+		}
+		tc.tamper(store)
+
+		result, err := VerifyAuditChain(ctx)
+		if err != nil {
+			t.Fatalf("%s: VerifyAuditChain: %s", tc.name, err.Error())
+		}
+		found := false
+		for _, problem := range result.Problems {
+			found = found || strings.Contains(problem.Problem, tc.want)
+		}
+		if result.Valid || !found {
+			t.Errorf("%s: problems = %+v, want %q", tc.name, result.Problems, tc.want)
+		}
+	}
+}
+
+func TestVerifyAuditChainKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	previous := GetSettings()
+	defer currentSettings.Store(previous)
+	settings := *previous
+	settings.Audit.SigningKey = "audit-key-one"
+	currentSettings.Store(&settings)
+
+	store := writeTestChain(t, 2)
+	if _, err := CreateAuditCheckpoint(ctx); err != nil {
+		t.Fatalf("CreateAuditCheckpoint: %s", err.Error())
+	}
+	rotated := settings
+	rotated.Audit.SigningKey = "audit-key-two"
+	rotated.Audit.PreviousSigningKeys = []string{"audit-key-one"}
+	currentSettings.Store(&rotated)
+	Audit(nil, AuditEvent{Action: ActionLogin, Category: CategorySuccess})
+	if _, err := CreateAuditCheckpoint(ctx); err != nil {
+		t.Fatalf("CreateAuditCheckpoint: %s", err.Error())
+	}
+	if store.checkpoints[0].KeyID == store.checkpoints[1].KeyID {
+		t.Fatal("checkpoints signed with different keys have the same key id")
+	}
+
+	result, err := VerifyAuditChain(ctx)
+	if err != nil {
+		t.Fatalf("VerifyAuditChain: %s", err.Error())
+	}
+	if !result.Valid || result.Checkpoints != 2 {
+		t.Errorf("rotated chain = %+v", result)
+	}
+
+	rotated.Audit.PreviousSigningKeys = nil
+	result, _ = VerifyAuditChain(ctx)
+	if result.Valid || len(result.Problems) != 1 ||
+		result.Problems[0].Problem != "checkpoint signed with an unknown key" {
+		t.Errorf("problems without the previous key = %+v", result.Problems)
+	}
+}
@@ -0,0 +1,475 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit events are kept for a retention period by category, set in
+// AUDIT_RETENTION as a list of CATEGORY=period with periods in days or with a
+// "y" suffix in years, e.g. "SUCCESS=90,UPDATE=7y".  Expired events are
+// archived to gzipped NDJSON files in LOG_DIR before they're deleted, and the
+// chain links of archived events are kept so the chain still verifies.  The
+// files are read back to verify the chain, so LOG_DIR is an absolute path
+// every instance shares.
+// Counts of events by day and month are rolled up before any are archived.
+
+const auditArchiveBatch = 1000
+
+var defaultAuditRetention = map[string]int{
+	CategoryDebug:        30,
+	CategorySuccess:      90,
+	CategoryLogout:       90,
+	CategoryError:        365,
+	CategoryUnauthorized: 365,
+	CategoryCreate:       7 * 365,
+	CategoryUpdate:       7 * 365,
+	CategoryDelete:       7 * 365,
+}
+
+// AuditArchiveLink is the chain link of an archived event.
+type AuditArchiveLink struct {
+	Seq      int64  `json:"seq" bson:"seq"`
+	PrevHash string `json:"prevHash" bson:"prevHash"`
+	Hash     string `json:"hash" bson:"hash"`
+}
+
+// AuditArchive records an archive file and the events moved to it.
+type AuditArchive struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	File     string             `json:"file" bson:"file"`
+	SHA256   string             `json:"sha256" bson:"sha256"`
+	Category string             `json:"category" bson:"category"`
+	From     time.Time          `json:"from" bson:"from"`
+	To       time.Time          `json:"to" bson:"to"`
+	Count    int                `json:"count" bson:"count"`
+	Links    []AuditArchiveLink `json:"-" bson:"links"`
+	Created  time.Time          `json:"created" bson:"created"`
+}
+
+// AuditRollup is the count of events for a day or month with the same
+// category, action, outcome and application.
+type AuditRollup struct {
+	ID          string    `json:"id" bson:"_id"`
+	Period      string    `json:"period" bson:"period"`
+	Start       time.Time `json:"start" bson:"start"`
+	Category    string    `json:"category" bson:"category"`
+	Action      string    `json:"action" bson:"action"`
+	Outcome     string    `json:"outcome" bson:"outcome"`
+	Application string    `json:"application" bson:"application"`
+	Count       int64     `json:"count" bson:"count"`
+}
+
+func getAuditArchiveCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "auditarchives")
+}
+
+func getAuditRollupCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "auditrollups")
+}
+
+// ensureAuditRetentionIndexes creates the index for finding rollups by period.
+func ensureAuditRetentionIndexes(ctx context.Context) error {
+	_, err := getAuditRollupCollection().Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "period", Value: 1}, {Key: "start", Value: -1}}})
+	return err
+}
+
+// GetAuditRetention provides the retention period in days for each category,
+// the defaults overridden by the audit.retention setting.
+func GetAuditRetention() (map[string]int, error) {
+	return GetSettings().auditRetention()
+}
+
+// auditRetention parses the retention setting, given in days ("30" or "30d")
+// or years ("7y") by category.
+func (s *Settings) auditRetention() (map[string]int, error) {
+	retention := make(map[string]int)
+	for category, days := range defaultAuditRetention {
+		retention[category] = days
+	}
+	for category, setting := range s.Audit.Retention {
+		period := strings.ToLower(strings.TrimSpace(setting))
+		multiplier := 1
+		if strings.HasSuffix(period, "y") {
+			multiplier = 365
+			period = strings.TrimSuffix(period, "y")
+		} else {
+			period = strings.TrimSuffix(period, "d")
+		}
+		days, err := strconv.Atoi(period)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("bad audit retention: %s=%s", category, setting)
+		}
+		retention[NormalizeCategory(category)] = days * multiplier
+	}
+	return retention, nil
+}
+
+// getArchivedLinks provides the chain links of every archived event by
+// sequence, as read from the archive files.  A file which is missing, doesn't
+// match its recorded SHA-256 or holds a modified event is reported to problem,
+// and the links recorded for it in MongoDB are checked against the file.
+func getArchivedLinks(ctx context.Context, problem func(seq int64, format string,
+	args ...interface{})) (map[int64]AuditArchiveLink, error) {
+	archives, err := GetStores().Audit.Archives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	links := make(map[int64]AuditArchiveLink)
+	for _, archive := range archives {
+		var first int64
+		if len(archive.Links) > 0 {
+			first = archive.Links[0].Seq
+		}
+		events, err := readAuditArchive(archive)
+		if err != nil {
+			problem(first, "archive %s: %s", archive.File, err.Error())
+			continue
+		}
+		inFile := make(map[int64]bool)
+		for _, evt := range events {
+			if evt.Seq <= 0 {
+				continue
+			}
+			if evt.computeHash() != evt.Hash {
+				problem(evt.Seq, "archived entry modified")
+			}
+			inFile[evt.Seq] = true
+			links[evt.Seq] = AuditArchiveLink{Seq: evt.Seq, PrevHash: evt.PrevHash,
+				Hash: evt.Hash}
+		}
+		for _, link := range archive.Links {
+			if !inFile[link.Seq] || links[link.Seq] != link {
+				problem(link.Seq, "archive %s doesn't hold the entry recorded", archive.File)
+			}
+		}
+	}
+	return links, nil
+}
+
+// readAuditArchive provides the events in the archive's file, once the file
+// is checked against its recorded SHA-256.
+func readAuditArchive(archive AuditArchive) ([]AuditEvent, error) {
+	data, err := os.ReadFile(archive.File)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != archive.SHA256 {
+		return nil, errors.New("file modified")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var events []AuditEvent
+	decoder := json.NewDecoder(zr)
+	for decoder.More() {
+		var evt AuditEvent
+		if err := decoder.Decode(&evt); err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	return events, nil
+}
+
+// ArchiveAuditEvents moves the events past their category's retention period
+// to archive files, providing the number archived.  Events are rolled up
+// first so their counts are kept.  The newest event of the chain is never
+// archived, as the chain would otherwise restart as though it was tampered
+// with.  Archiving needs MongoDB, so nothing is archived without it.
+func ArchiveAuditEvents(ctx context.Context) (int, error) {
+	if config.DB == nil {
+		return 0, ErrNoDatabase
+	}
+	retention, err := GetAuditRetention()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := RollupAuditEvents(ctx); err != nil {
+		return 0, err
+	}
+	dir := GetSettings().Audit.ArchiveDir
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return 0, err
+	}
+
+	// the head of the chain is always kept, so new events continue the chain
+	head, err := GetStores().Audit.Last(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var headSeq int64
+	if head != nil {
+		headSeq = head.Seq
+	}
+
+	total := 0
+	now := time.Now().UTC()
+	for category, days := range retention {
+		cutoff := now.AddDate(0, 0, -days)
+		for {
+			count, err := archiveAuditBatch(ctx, dir, category, cutoff, headSeq)
+			total += count
+			if err != nil {
+				return total, err
+			}
+			if count < auditArchiveBatch {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// archiveAuditBatch writes the oldest expired events of the category, other
+// than the chain's head, to a new archive file and deletes them once the file
+// and its record are saved.
+func archiveAuditBatch(ctx context.Context, dir, category string,
+	cutoff time.Time, headSeq int64) (int, error) {
+	filter := bson.M{
+		"category": category,
+		"time":     bson.M{"$lt": cutoff},
+	}
+	if headSeq > 0 {
+		filter["seq"] = bson.M{"$ne": headSeq}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: 1}}).
+		SetLimit(auditArchiveBatch)
+	var events []AuditEvent
+	cursor, err := getAuditCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err = cursor.All(ctx, &events); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	archive := AuditArchive{
+		ID:       primitive.NewObjectID(),
+		Category: category,
+		From:     events[0].Time,
+		To:       events[len(events)-1].Time,
+		Count:    len(events),
+		Created:  time.Now().UTC(),
+	}
+	archive.File = filepath.Join(dir, fmt.Sprintf("audit-%s-%s-%s.ndjson.gz",
+		strings.ToLower(category), archive.From.Format("20060102"), archive.ID.Hex()))
+	if archive.SHA256, err = writeAuditArchive(archive.File, events); err != nil {
+		return 0, err
+	}
+
+	var ids []primitive.ObjectID
+	for _, evt := range events {
+		ids = append(ids, evt.ID)
+		if evt.Seq > 0 {
+			archive.Links = append(archive.Links, AuditArchiveLink{
+				Seq:      evt.Seq,
+				PrevHash: evt.PrevHash,
+				Hash:     evt.Hash,
+			})
+		}
+	}
+	if _, err := getAuditArchiveCollection().InsertOne(ctx, archive); err != nil {
+		return 0, err
+	}
+	_, err = getAuditCollection().DeleteMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// writeAuditArchive writes the events, one JSON object per line, to the
+// gzipped file, providing the file's SHA-256.
+func writeAuditArchive(path string, events []AuditEvent) (string, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(file, hash))
+	buf := bufio.NewWriter(zw)
+	encoder := json.NewEncoder(buf)
+	for _, evt := range events {
+		if err := encoder.Encode(evt); err != nil {
+			return "", err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RollupAuditEvents counts the events of each complete day after the last
+// daily rollup, and updates the rollups of the months those days are in.  A
+// day is only rolled up once, as its events may be archived afterwards and
+// counting them again would lose them from its rollups.
+func RollupAuditEvents(ctx context.Context) (int, error) {
+	if config.DB == nil {
+		return 0, ErrNoDatabase
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	var start time.Time
+	var last AuditRollup
+	opts := options.FindOne().SetSort(bson.D{{Key: "start", Value: -1}})
+	err := getAuditRollupCollection().FindOne(ctx,
+		bson.M{"period": "day"}, opts).Decode(&last)
+	if err == nil {
+		start = last.Start.UTC().AddDate(0, 0, 1)
+	} else if err == mongo.ErrNoDocuments {
+		var first AuditEvent
+		opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: 1}})
+		err := getAuditCollection().FindOne(ctx, bson.M{}, opts).Decode(&first)
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		start = first.Time.UTC().Truncate(24 * time.Hour)
+	} else {
+		return 0, err
+	}
+
+	days := 0
+	months := make(map[time.Time]bool)
+	for day := start; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if err := rollupAuditPeriod(ctx, "day", day, getAuditCollection(), bson.M{
+			"time": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)},
+		}, 1); err != nil {
+			return days, err
+		}
+		months[time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)] = true
+		days++
+	}
+	for month := range months {
+		if err := rollupAuditPeriod(ctx, "month", month, getAuditRollupCollection(), bson.M{
+			"period": "day",
+			"start":  bson.M{"$gte": month, "$lt": month.AddDate(0, 1, 0)},
+		}, "$count"); err != nil {
+			return days, err
+		}
+	}
+	return days, nil
+}
+
+// rollupAuditPeriod groups the matching documents of the source collection and
+// saves the sums as the rollups for the period.
+func rollupAuditPeriod(ctx context.Context, period string, start time.Time,
+	source *mongo.Collection,
+	match bson.M, count interface{}) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"category":    "$category",
+				"action":      "$action",
+				"outcome":     "$outcome",
+				"application": "$application",
+			},
+			"count": bson.M{"$sum": count},
+		}}},
+	}
+	cursor, err := source.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Key struct {
+			Category    string `bson:"category"`
+			Action      string `bson:"action"`
+			Outcome     string `bson:"outcome"`
+			Application string `bson:"application"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		rollup := AuditRollup{
+			Period:      period,
+			Start:       start,
+			Category:    group.Key.Category,
+			Action:      group.Key.Action,
+			Outcome:     group.Key.Outcome,
+			Application: group.Key.Application,
+			Count:       group.Count,
+		}
+		rollup.ID = strings.Join([]string{period, start.Format("2006-01-02"),
+			rollup.Category, rollup.Action, rollup.Outcome, rollup.Application}, "|")
+		_, err := getAuditRollupCollection().ReplaceOne(ctx,
+			bson.M{"_id": rollup.ID}, rollup, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAuditRollups provides the day or month rollups starting in the range,
+// oldest first.
+func GetAuditRollups(ctx context.Context, period string, from,
+	to *time.Time) ([]AuditRollup, error) {
+	if config.DB == nil {
+		return nil, ErrNoDatabase
+	}
+	filter := bson.M{"period": period}
+	if from != nil || to != nil {
+		start := bson.M{}
+		if from != nil {
+			start["$gte"] = *from
+		}
+		if to != nil {
+			start["$lt"] = *to
+		}
+		filter["start"] = start
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "start", Value: 1}})
+	rollups := []AuditRollup{}
+	cursor, err := getAuditRollupCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
@@ -0,0 +1,400 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Audit categories, replacing the mixed case categories of the free-text log.
+const (
+	CategoryDebug        = "DEBUG"
+	CategoryError        = "ERROR"
+	CategorySuccess      = "SUCCESS"
+	CategoryUnauthorized = "UNAUTHORIZED"
+	CategoryLogout       = "LOGOUT"
+	CategoryCreate       = "CREATE"
+	CategoryUpdate       = "UPDATE"
+	CategoryDelete       = "DELETE"
+)
+
+// Audit outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Audit actions for the events recorded with a target user.
+const (
+	ActionLogin          = "login"
+	ActionLogout         = "logout"
+	ActionRenewToken     = "token.renew"
+	ActionUserCreate     = "user.create"
+	ActionUserUpdate     = "user.update"
+	ActionUserDelete     = "user.delete"
+	ActionUserRestore    = "user.restore"
+	ActionUserMerge      = "user.merge"
+	ActionUserStatus     = "user.status"
+	ActionPasswordReset  = "password.reset"
+	ActionPasswordChange = "password.change"
+	ActionEmailChange    = "email.change"
+	ActionInviteAccept   = "invite.accept"
+	ActionInviteSend     = "invite.send"
+	ActionInviteRevoke   = "invite.revoke"
+)
+
+const redacted = "[REDACTED]"
+
+// AuditChange is the before and after value of one field of a change.
+type AuditChange struct {
+	Field  string `json:"field" bson:"field"`
+	Before string `json:"before" bson:"before"`
+	After  string `json:"after" bson:"after"`
+}
+
+// AuditEvent is one entry of the audit trail.
+type AuditEvent struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Seq         int64              `json:"seq,omitempty" bson:"seq,omitempty"`
+	PrevHash    string             `json:"prevHash,omitempty" bson:"prevHash,omitempty"`
+	Hash        string             `json:"hash,omitempty" bson:"hash,omitempty"`
+	Time        time.Time          `json:"time" bson:"time"`
+	ActorID     string             `json:"actorId,omitempty" bson:"actorId,omitempty"`
+	ActorEmail  string             `json:"actorEmail,omitempty" bson:"actorEmail,omitempty"`
+	TargetID    string             `json:"targetId,omitempty" bson:"targetId,omitempty"`
+	TargetEmail string             `json:"targetEmail,omitempty" bson:"targetEmail,omitempty"`
+	Action      string             `json:"action" bson:"action"`
+	Category    string             `json:"category" bson:"category"`
+	Outcome     string             `json:"outcome" bson:"outcome"`
+	Changes     []AuditChange      `json:"changes,omitempty" bson:"changes,omitempty"`
+	Application string             `json:"application,omitempty" bson:"application,omitempty"`
+	Portion     string             `json:"portion,omitempty" bson:"portion,omitempty"`
+	IPAddress   string             `json:"ipAddress,omitempty" bson:"ipAddress,omitempty"`
+	UserAgent   string             `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	RequestID   string             `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	Message     string             `json:"message,omitempty" bson:"message,omitempty"`
+}
+
+// secretFields are the names, in lower case, of the fields and log attributes
+// whose values are never recorded.  The names are matched whole, so fields
+// such as passwordExpires are kept.
+var secretFields = map[string]bool{
+	"password":        true,
+	"passwd":          true,
+	"currentpassword": true,
+	"newpassword":     true,
+	"token":           true,
+	"resettoken":      true,
+	"changetoken":     true,
+	"authorization":   true,
+	"secret":          true,
+	"code":            true,
+	"key":             true,
+}
+
+func isSecretField(name string) bool {
+	return secretFields[strings.ToLower(name)]
+}
+
+func getAuditCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "audit")
+}
+
+// ensureAuditIndexes creates the indexes for the audit queries: by time, and
+// by actor, target user, action and outcome over time.
+func ensureAuditIndexes(ctx context.Context) error {
+	_, err := getAuditCollection().Indexes().CreateMany(ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "targetId", Value: 1}, {Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "action", Value: 1}, {Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "category", Value: 1}, {Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "outcome", Value: 1}, {Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "requestId", Value: 1}}},
+		})
+	return err
+}
+
+// NormalizeCategory maps the categories used by the older log entries to the
+// audit categories.
+func NormalizeCategory(category string) string {
+	return strings.ToUpper(strings.TrimSpace(category))
+}
+
+// categoryOutcome provides the outcome implied by a category.
+func categoryOutcome(category string) string {
+	switch category {
+	case CategoryUnauthorized:
+		return OutcomeDenied
+	case CategoryDebug, CategoryError:
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
+
+// RedactValue hides the value of secret fields, such as passwords and tokens.
+func RedactValue(field, value string) string {
+	if value != "" && isSecretField(field) {
+		return redacted
+	}
+	return value
+}
+
+// NewChange provides the change of a field with secret values redacted.
+func NewChange(field, before, after string) AuditChange {
+	return AuditChange{
+		Field:  field,
+		Before: RedactValue(field, before),
+		After:  RedactValue(field, after),
+	}
+}
+
+// DiffUsers provides the changes between two versions of a user record.  The
+// password is only reported as changed.
+func DiffUsers(before, after users.User) []AuditChange {
+	var changes []AuditChange
+	add := func(field, b, a string) {
+		if b != a {
+			changes = append(changes, NewChange(field, b, a))
+		}
+	}
+	add("emailAddress", before.EmailAddress, after.EmailAddress)
+	add("firstName", before.FirstName, after.FirstName)
+	add("middleName", before.MiddleName, after.MiddleName)
+	add("lastName", before.LastName, after.LastName)
+	add("password", before.Password, after.Password)
+	add("badAttempts", fmt.Sprint(before.BadAttempts), fmt.Sprint(after.BadAttempts))
+	add("passwordExpires", before.PasswordExpires.UTC().Format(time.RFC3339),
+		after.PasswordExpires.UTC().Format(time.RFC3339))
+
+	bWG := append([]string(nil), before.Workgroups...)
+	aWG := append([]string(nil), after.Workgroups...)
+	sort.Strings(bWG)
+	sort.Strings(aWG)
+	add("workgroups", strings.Join(bWG, ","), strings.Join(aWG, ","))
+	return changes
+}
+
+// CopyUser provides a copy of the user record which doesn't share its
+// workgroups, for comparing before and after a change.
+func CopyUser(user users.User) users.User {
+	user.Workgroups = append([]string(nil), user.Workgroups...)
+	return user
+}
+
+// GetRequestID provides the request's correlation ID.
+func GetRequestID(c *gin.Context) string {
+	if id := c.GetString("requestid"); id != "" {
+		return id
+	}
+	return c.GetHeader("X-Request-ID")
+}
+
+// Audit records the event, filling in the actor, client and request details
+// from the request context and the outcome from the category when not given.
+func Audit(c *gin.Context, evt AuditEvent) error {
+	evt.ID = primitive.NewObjectID()
+	evt.Time = time.Now().UTC().Truncate(time.Millisecond)
+	evt.Category = NormalizeCategory(evt.Category)
+	if evt.Outcome == "" {
+		evt.Outcome = categoryOutcome(evt.Category)
+	}
+	// the event is written even when the client has gone away
+	ctx := context.Background()
+	if c != nil {
+		ctx = context.WithoutCancel(c.Request.Context())
+		if evt.ActorID == "" {
+			evt.ActorID = svcs.GetRequestor(c)
+		}
+		if identity := c.GetString("serviceidentity"); evt.ActorID == "" && identity != "" {
+			evt.ActorID = "service:" + identity
+		}
+		evt.IPAddress = c.ClientIP()
+		evt.UserAgent = c.Request.UserAgent()
+		evt.RequestID = GetRequestID(c)
+	}
+	if evt.ActorID != "" && evt.ActorEmail == "" &&
+		!strings.HasPrefix(evt.ActorID, "service:") {
+		if actor, err := GetStores().Users.GetByID(ctx, evt.ActorID); err == nil {
+			evt.ActorEmail = actor.EmailAddress
+		}
+	}
+	for i, change := range evt.Changes {
+		evt.Changes[i] = NewChange(change.Field, change.Before, change.After)
+	}
+
+	ctx, span := StartSpan(ctx, "audit.write",
+		attribute.String("audit.action", evt.Action))
+	err := appendAuditEvent(ctx, evt)
+	EndSpan(span, err)
+	if err != nil {
+		Logger.Error("Audit: event not written", "action", evt.Action,
+			"request_id", evt.RequestID, "error", err)
+	}
+	return err
+}
+
+// AuditUser records an event about the target user.
+func AuditUser(c *gin.Context, action, category string, target users.User,
+	application, msg string, changes ...AuditChange) error {
+	return Audit(c, AuditEvent{
+		Action:      action,
+		Category:    category,
+		TargetID:    target.ID.Hex(),
+		TargetEmail: target.EmailAddress,
+		Application: application,
+		Message:     msg,
+		Changes:     changes,
+	})
+}
+
+// AuditFailure records a request for the action which failed without a user
+// record to report it against, such as a malformed request.  The target is
+// the requested user's ID, when known.
+func AuditFailure(c *gin.Context, action, targetID, msg string) error {
+	return Audit(c, AuditEvent{
+		Action:   action,
+		Category: CategoryError,
+		TargetID: targetID,
+		Message:  msg,
+	})
+}
+
+// AuditFilter selects audit events.  Blank fields aren't filtered on, and the
+// date range includes From and excludes To.
+type AuditFilter struct {
+	UserID      string // either the actor or the target
+	ActorID     string
+	TargetID    string
+	Action      string
+	Category    string
+	Application string
+	Outcome     string
+	From        *time.Time
+	To          *time.Time
+}
+
+func (f AuditFilter) query() bson.M {
+	filter := bson.M{}
+	if f.UserID != "" {
+		filter["$or"] = []bson.M{
+			{"actorId": f.UserID},
+			{"targetId": f.UserID},
+		}
+	}
+	if f.ActorID != "" {
+		filter["actorId"] = f.ActorID
+	}
+	if f.TargetID != "" {
+		filter["targetId"] = f.TargetID
+	}
+	if f.Action != "" {
+		filter["action"] = f.Action
+	}
+	if f.Category != "" {
+		filter["category"] = NormalizeCategory(f.Category)
+	}
+	if f.Application != "" {
+		filter["application"] = f.Application
+	}
+	if f.Outcome != "" {
+		filter["outcome"] = strings.ToLower(f.Outcome)
+	}
+	if f.From != nil || f.To != nil {
+		period := bson.M{}
+		if f.From != nil {
+			period["$gte"] = *f.From
+		}
+		if f.To != nil {
+			period["$lt"] = *f.To
+		}
+		filter["time"] = period
+	}
+	return filter
+}
+
+// GetAuditEvents provides a page of the events matching the filter, newest
+// first, and the total number matching.  Pages start at 1.
+func GetAuditEvents(ctx context.Context, filter AuditFilter, page,
+	pageSize int64) ([]AuditEvent, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	total, err := GetStores().Audit.Count(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	events, err := GetStores().Audit.Find(ctx, filter, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// GetUserTimeline provides the events the user performed or was the target
+// of, newest first.
+func GetUserTimeline(ctx context.Context, userID string, from, to *time.Time,
+	limit int64) ([]AuditEvent, error) {
+	filter := AuditFilter{UserID: userID, From: from, To: to}
+	return GetStores().Audit.Find(ctx, filter, 0, limit)
+}
+
+var auditCSVHeader = []string{"time", "actorId", "actorEmail", "targetId",
+	"targetEmail", "action", "category", "outcome", "application", "ipAddress",
+	"userAgent", "requestId", "message", "changes"}
+
+// WriteAuditCSV writes the events as CSV with a header row.  The changes are
+// written as "field: before -> after" separated by semicolons.  Values a
+// spreadsheet would run as a formula, such as a user agent starting with =,
+// are prefixed with a quote.
+func WriteAuditCSV(w io.Writer, events []AuditEvent) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(auditCSVHeader); err != nil {
+		return err
+	}
+	for _, evt := range events {
+		var changes []string
+		for _, change := range evt.Changes {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", change.Field,
+				change.Before, change.After))
+		}
+		record := []string{
+			evt.Time.Format(time.RFC3339), evt.ActorID, evt.ActorEmail,
+			evt.TargetID, evt.TargetEmail, evt.Action, evt.Category, evt.Outcome,
+			evt.Application, evt.IPAddress, evt.UserAgent, evt.RequestID,
+			evt.Message, strings.Join(changes, "; "),
+		}
+		for i := range record {
+			record[i] = escapeCSVFormula(record[i])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// escapeCSVFormula prefixes the value with a quote when it starts with a
+// character spreadsheets treat as the start of a formula.
+func escapeCSVFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
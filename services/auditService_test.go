@@ -0,0 +1,96 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestWriteAuditCSV(t *testing.T) {
+	events := []AuditEvent{{
+		Time:        time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ActorID:     "actor",
+		TargetEmail: "user@example.com",
+		Action:      ActionUserUpdate,
+		Category:    CategoryUpdate,
+		Outcome:     OutcomeSuccess,
+		UserAgent:   "=HYPERLINK(\"http://evil\")",
+		Message:     "-1+1",
+		Changes: []AuditChange{
+			{Field: "firstName", Before: "Jo", After: "Joe"},
+			{Field: "password", Before: "", After: redacted},
+		},
+	}}
+
+	var buf bytes.Buffer
+	if err := WriteAuditCSV(&buf, events); err != nil {
+		t.Fatalf("WriteAuditCSV: %s", err.Error())
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("written CSV unreadable: %s", err.Error())
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want the header and one event", len(records))
+	}
+	if len(records[0]) != len(auditCSVHeader) || records[0][0] != "time" {
+		t.Errorf("header = %v", records[0])
+	}
+
+	row := make(map[string]string)
+	for i, name := range auditCSVHeader {
+		row[name] = records[1][i]
+	}
+	for name, want := range map[string]string{
+		"time":        "2024-03-01T12:30:00Z",
+		"actorId":     "actor",
+		"targetEmail": "user@example.com",
+		"action":      ActionUserUpdate,
+		"userAgent":   "'=HYPERLINK(\"http://evil\")",
+		"message":     "'-1+1",
+		"changes":     "firstName: Jo -> Joe; password:  -> " + redacted,
+	} {
+		if row[name] != want {
+			t.Errorf("%s = %q, want %q", name, row[name], want)
+		}
+	}
+}
+
+func TestEscapeCSVFormula(t *testing.T) {
+	for value, want := range map[string]string{
+		"":          "",
+		"plain":     "plain",
+		"=1+2":      "'=1+2",
+		"+1":        "'+1",
+		"-1":        "'-1",
+		"@SUM(A1)":  "'@SUM(A1)",
+		"\tindent":  "'\tindent",
+		"a=b":       "a=b",
+		"user@host": "user@host",
+	} {
+		if got := escapeCSVFormula(value); got != want {
+			t.Errorf("escapeCSVFormula(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	for _, tc := range []struct {
+		field, value, want string
+	}{
+		{"password", "Correct-Horse-42", redacted},
+		{"Password", "Correct-Horse-42", redacted},
+		{"resetToken", "123456", redacted},
+		{"code", "123456", redacted},
+		{"password", "", ""},
+		{"passwordExpires", "2024-03-01", "2024-03-01"},
+		{"badAttempts", "3", "3"},
+		{"emailAddress", "user@example.com", "user@example.com"},
+	} {
+		if got := RedactValue(tc.field, tc.value); got != tc.want {
+			t.Errorf("RedactValue(%q, %q) = %q, want %q", tc.field, tc.value, got,
+				tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DeletedUser marks a user record as deactivated.  The user record itself is
+// left in place, so the user's history and employee link survive, until the
+// retention period has passed and the record is purged.
+type DeletedUser struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	EmailAddress string             `json:"emailAddress" bson:"emailAddress"`
+	Name         string             `json:"name" bson:"name"`
+	DeletedOn    time.Time          `json:"deletedOn" bson:"deletedOn"`
+	DeletedBy    string             `json:"deletedBy" bson:"deletedBy"`
+}
+
+func getDeletedUserCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "deletedusers")
+}
+
+// DeactivateUser marks the user as deleted by the requestor given.  The user
+// is unable to log in until restored.  Deactivating a user already deleted
+// keeps the original mark, so the retention period isn't restarted.
+func DeactivateUser(ctx context.Context, id, deletedBy string) (*DeletedUser, error) {
+	user, err := GetStores().Users.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = GetStores().Accounts.MarkDeleted(ctx, DeletedUser{
+		ID:           user.ID,
+		EmailAddress: user.EmailAddress,
+		Name:         user.GetLastFirst(),
+		DeletedOn:    time.Now().UTC(),
+		DeletedBy:    deletedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetDeletedUser(ctx, user.ID)
+}
+
+// RestoreUser removes the deactivation mark from the user record.
+func RestoreUser(ctx context.Context, id string) error {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	restored, err := GetStores().Accounts.Restore(ctx, oID)
+	if err != nil {
+		return err
+	}
+	if !restored {
+		return errors.New("user not deleted")
+	}
+	return nil
+}
+
+// GetDeletedUser provides the deactivation mark for the user, if the user
+// isn't deactivated mongo.ErrNoDocuments is returned.
+func GetDeletedUser(ctx context.Context, id primitive.ObjectID) (*DeletedUser, error) {
+	return GetStores().Accounts.GetDeleted(ctx, id)
+}
+
+// IsUserDeleted reports whether the user has been deactivated.  When it can't
+// be told the user is reported deleted with the error, so a database problem
+// never lets a deleted user in.
+func IsUserDeleted(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	_, err := GetDeletedUser(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return true, err
+}
+
+func GetDeletedUsers(ctx context.Context) ([]DeletedUser, error) {
+	return GetStores().Accounts.GetAllDeleted(ctx)
+}
+
+// PurgeDeletedUsers hard deletes the user records deactivated more than the
+// given number of days ago, returning the number of users purged.  A user
+// which can't be purged doesn't stop the others, every problem is reported in
+// the error.
+func PurgeDeletedUsers(ctx context.Context, days int) (int, error) {
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+	deleted, err := GetStores().Accounts.GetAllDeleted(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var problems []error
+	for _, du := range deleted {
+		if !du.DeletedOn.Before(cutoff) {
+			continue
+		}
+		if err := GetStores().Users.Delete(ctx, du.ID.Hex()); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s", du.ID.Hex(), err.Error()))
+			continue
+		}
+		if _, err := GetStores().Accounts.Restore(ctx, du.ID); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s", du.ID.Hex(), err.Error()))
+			continue
+		}
+		count++
+	}
+	return count, errors.Join(problems...)
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DuplicateUsers is a group of user records which likely belong to the same
+// person, either sharing an email address in different case or sharing a
+// first and last name with different email addresses.
+type DuplicateUsers struct {
+	Reason string       `json:"reason"`
+	Key    string       `json:"key"`
+	Users  []users.User `json:"users"`
+}
+
+// FindDuplicateUsers reports the groups of possibly duplicated users.
+func FindDuplicateUsers(ctx context.Context) ([]DuplicateUsers, error) {
+	usrs, err := GetStores().Users.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byEmail := make(map[string][]users.User)
+	byName := make(map[string][]users.User)
+	for _, user := range usrs {
+		email := strings.ToLower(strings.TrimSpace(user.EmailAddress))
+		byEmail[email] = append(byEmail[email], user)
+		name := strings.ToLower(strings.TrimSpace(user.FirstName) + " " +
+			strings.TrimSpace(user.LastName))
+		byName[name] = append(byName[name], user)
+	}
+
+	var dups []DuplicateUsers
+	for key, list := range byEmail {
+		if len(list) > 1 {
+			dups = append(dups, DuplicateUsers{Reason: "email", Key: key, Users: list})
+		}
+	}
+	for key, list := range byName {
+		if len(list) < 2 {
+			continue
+		}
+		// users with the same name and same email are already reported
+		emails := make(map[string]bool)
+		for _, user := range list {
+			emails[strings.ToLower(strings.TrimSpace(user.EmailAddress))] = true
+		}
+		if len(emails) > 1 {
+			dups = append(dups, DuplicateUsers{Reason: "name", Key: key, Users: list})
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		if dups[i].Reason != dups[j].Reason {
+			return dups[i].Reason < dups[j].Reason
+		}
+		return dups[i].Key < dups[j].Key
+	})
+	return dups, nil
+}
+
+// MergeUsers combines the removed user into the kept user.  The workgroups are
+// combined, the removed user's employee record is moved to the kept user when
+// the kept user doesn't have one, and the removed user record is deleted.
+func MergeUsers(ctx context.Context, keepID, removeID string) (*users.User, error) {
+	if keepID == removeID {
+		return nil, errors.New("cannot merge a user with itself")
+	}
+	keep, err := GetStores().Users.GetByID(ctx, keepID)
+	if err != nil {
+		return nil, err
+	}
+	remove, err := GetStores().Users.GetByID(ctx, removeID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, wg := range remove.Workgroups {
+		found := false
+		for _, kwg := range keep.Workgroups {
+			if strings.EqualFold(wg, kwg) {
+				found = true
+			}
+		}
+		if !found {
+			keep.Workgroups = append(keep.Workgroups, strings.ToLower(wg))
+		}
+	}
+
+	if err := moveEmployeeLink(ctx, keep.ID, remove.ID); err != nil {
+		return nil, err
+	}
+
+	if err := GetStores().Users.Update(ctx, *keep); err != nil {
+		return nil, err
+	}
+	if err := GetStores().Users.Delete(ctx, remove.ID.Hex()); err != nil {
+		return nil, err
+	}
+
+	// remove the records kept for the removed user
+	GetStores().Accounts.Restore(ctx, remove.ID)
+	GetStores().Accounts.DeleteStatus(ctx, remove.ID)
+	GetStores().Invitations.Delete(ctx, remove.ID)
+	GetStores().EmailChanges.Delete(ctx, remove.ID)
+	return keep, nil
+}
+
+// moveEmployeeLink re-keys the removed user's employee record, since the
+// employee and user records share an object ID.
+func moveEmployeeLink(ctx context.Context, keepID, removeID primitive.ObjectID) error {
+	empStore := GetStores().Employees
+
+	removeEmp, err := empStore.GetByID(ctx, removeID)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = empStore.GetByID(ctx, keepID)
+	if err == nil {
+		return errors.New("both users have employee records")
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	removeEmp.ID = keepID
+	if err := empStore.Insert(ctx, *removeEmp); err != nil {
+		return err
+	}
+	_, err = empStore.Delete(ctx, removeID)
+	return err
+}
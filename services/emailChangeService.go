@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxEmailChangeAttempts is the number of bad codes allowed before a pending
+// email change is cancelled.
+const maxEmailChangeAttempts = 5
+
+// EmailChange is a pending change of a user's email address.  The change isn't
+// made until the code sent to the new address is confirmed.
+type EmailChange struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	OldEmail string             `json:"oldEmail" bson:"oldEmail"`
+	NewEmail string             `json:"newEmail" bson:"newEmail"`
+	CodeHash string             `json:"-" bson:"codeHash"`
+	Attempts int                `json:"attempts" bson:"attempts"`
+	Created  time.Time          `json:"created" bson:"created"`
+	Expires  time.Time          `json:"expires" bson:"expires"`
+}
+
+// EmailRevert allows the previous address to undo a confirmed email change,
+// in case the change was made by someone who took over the account.
+type EmailRevert struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	UserID    primitive.ObjectID `json:"userid" bson:"userid"`
+	OldEmail  string             `json:"oldEmail" bson:"oldEmail"`
+	NewEmail  string             `json:"newEmail" bson:"newEmail"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	Expires   time.Time          `json:"expires" bson:"expires"`
+	Reverted  *time.Time         `json:"reverted,omitempty" bson:"reverted,omitempty"`
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// emailCollation compares email addresses without regard to case.
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+func getEmailChangeCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "emailchanges")
+}
+
+func getEmailRevertCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "emailreverts")
+}
+
+func randomCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+// IsEmailInUse reports whether the email address, ignoring case, belongs to a
+// user other than the one given or is the target of another user's pending
+// email change.
+func IsEmailInUse(ctx context.Context, email string,
+	exceptID primitive.ObjectID) (bool, error) {
+	user, err := GetStores().Users.GetByEmail(ctx, email)
+	if err == nil && user.ID != exceptID {
+		return true, nil
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		return false, err
+	}
+	return GetStores().EmailChanges.IsPending(ctx, email, exceptID,
+		time.Now().UTC())
+}
+
+// StartEmailChange records the pending change and sends a confirmation code and
+// link to the new address.  The user's email address isn't changed until the
+// code is confirmed.
+func StartEmailChange(ctx context.Context, user users.User,
+	newEmail string) (*EmailChange, error) {
+	newEmail = strings.TrimSpace(newEmail)
+	if !emailPattern.MatchString(newEmail) {
+		return nil, errors.New("invalid email address")
+	}
+	if strings.EqualFold(newEmail, user.EmailAddress) {
+		return nil, errors.New("email address unchanged")
+	}
+	inUse, err := IsEmailInUse(ctx, newEmail, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, errors.New("email address already in use")
+	}
+
+	code := randomCode()
+	now := time.Now().UTC()
+	change := EmailChange{
+		ID:       user.ID,
+		OldEmail: user.EmailAddress,
+		NewEmail: newEmail,
+		CodeHash: hashToken(code),
+		Created:  now,
+		Expires:  now.Add(time.Minute * time.Duration(GetSettings().Users.EmailChangeExpiryMinutes)),
+	}
+	if err := GetStores().EmailChanges.Save(ctx, change); err != nil {
+		return nil, err
+	}
+
+	link := fmt.Sprintf("%s?id=%s&code=%s",
+		GetSettings().Users.EmailConfirmURL,
+		user.ID.Hex(), code)
+	err = SendTemplateEmail(ctx, []string{newEmail}, "emailconfirm", "",
+		map[string]interface{}{
+			"Code": code,
+			"Link": link,
+		})
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// GetEmailChange provides the user's pending email change.
+func GetEmailChange(ctx context.Context, id primitive.ObjectID) (*EmailChange, error) {
+	return GetStores().EmailChanges.Get(ctx, id)
+}
+
+// ConfirmEmailChange completes a pending email change when the code matches,
+// providing the updated user.  The previous address is notified of the change
+// with a link to revert it.
+func ConfirmEmailChange(ctx context.Context, id primitive.ObjectID,
+	code string) (*users.User, error) {
+	change, err := GetEmailChange(ctx, id)
+	if err != nil {
+		return nil, errors.New("no pending email change")
+	}
+	if time.Now().UTC().After(change.Expires) {
+		return nil, errors.New("email change expired")
+	}
+	if !hmac.Equal([]byte(change.CodeHash), []byte(hashToken(code))) {
+		change.Attempts++
+		if change.Attempts >= maxEmailChangeAttempts {
+			GetStores().EmailChanges.Delete(ctx, id)
+			return nil, errors.New("too many bad codes, email change cancelled")
+		}
+		GetStores().EmailChanges.Save(ctx, *change)
+		return nil, errors.New("bad verification code")
+	}
+
+	// the address may have been taken since the change was started
+	inUse, err := IsEmailInUse(ctx, change.NewEmail, id)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, errors.New("email address already in use")
+	}
+
+	user, err := GetStores().Users.GetByID(ctx, id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	user.EmailAddress = change.NewEmail
+	if err := GetStores().Users.Update(ctx, *user); err != nil {
+		return nil, err
+	}
+
+	if err := GetStores().EmailChanges.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+
+	// the change is made, so a notification problem is only logged
+	if err := notifyEmailChanged(ctx, *change); err != nil {
+		Logger.Error("ConfirmEmailChange: notifyEmailChanged problem", "error", err)
+	}
+	return user, nil
+}
+
+// notifyEmailChanged sends the previous address notice of the change along with
+// a link to revert it.
+func notifyEmailChanged(ctx context.Context, change EmailChange) error {
+	token := RandomToken(32)
+	revert := EmailRevert{
+		ID:        primitive.NewObjectID(),
+		UserID:    change.ID,
+		OldEmail:  change.OldEmail,
+		NewEmail:  change.NewEmail,
+		TokenHash: hashToken(token),
+		Expires: time.Now().UTC().AddDate(0, 0,
+			GetSettings().Users.EmailRevertDays),
+	}
+	if err := GetStores().EmailChanges.InsertRevert(ctx, revert); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s?token=%s",
+		GetSettings().Users.EmailRevertURL, token)
+	return SendTemplateEmail(ctx, []string{change.OldEmail}, "emailchanged", "",
+		map[string]interface{}{
+			"NewEmail": change.NewEmail,
+			"Link":     link,
+		})
+}
+
+// RevertEmailChange restores the previous email address from a revert link.
+// Any outstanding password reset is cancelled, since it was sent to the
+// address being removed.
+func RevertEmailChange(ctx context.Context, token string) (*users.User, error) {
+	revert, err := GetStores().EmailChanges.GetRevert(ctx, hashToken(token))
+	if err != nil {
+		return nil, errors.New("invalid revert token")
+	}
+	if revert.Reverted != nil {
+		return nil, errors.New("email change already reverted")
+	}
+	if time.Now().UTC().After(revert.Expires) {
+		return nil, errors.New("revert token expired")
+	}
+
+	inUse, err := IsEmailInUse(ctx, revert.OldEmail, revert.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, errors.New("email address already in use")
+	}
+
+	user, err := GetStores().Users.GetByID(ctx, revert.UserID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	user.EmailAddress = revert.OldEmail
+	user.ResetToken = ""
+	user.ResetTokenExp = nil
+	if err := GetStores().Users.Update(ctx, *user); err != nil {
+		return nil, err
+	}
+
+	if err := GetStores().EmailChanges.MarkReverted(ctx, revert.ID,
+		time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	GetStores().EmailChanges.Delete(ctx, revert.UserID)
+	return user, nil
+}
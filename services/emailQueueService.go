@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxMessage is a rendered email waiting for, or finished with, delivery.
+// Failed deliveries are retried with an exponential backoff until the maximum
+// attempts (EMAIL_MAX_ATTEMPTS, default 8), then the message is dead-lettered
+// for an admin to review and retry.  The rendered message holds reset tokens
+// and invitation links, so it's stored encrypted with the id of the key used,
+// removed once sent and never provided through the API.
+type OutboxMessage struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	To          []string           `json:"to" bson:"to"`
+	Template    string             `json:"template" bson:"template"`
+	Application string             `json:"application" bson:"application"`
+	Message     EmailMessage       `json:"-" bson:"-"`
+	Sealed      string             `json:"-" bson:"sealed,omitempty"`
+	KeyID       string             `json:"-" bson:"keyId,omitempty"`
+	Status      string             `json:"status" bson:"status"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	NextAttempt time.Time          `json:"nextAttempt" bson:"nextAttempt"`
+	LockedUntil *time.Time         `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+	LastError   string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Created     time.Time          `json:"created" bson:"created"`
+	Sent        *time.Time         `json:"sent,omitempty" bson:"sent,omitempty"`
+}
+
+func getOutboxCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "outbox")
+}
+
+// QueueEmail stores the message in the outbox for the worker to deliver.
+func QueueEmail(ctx context.Context, to []string, template, application string,
+	msg EmailMessage) (*OutboxMessage, error) {
+	if len(to) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	gcm, keyID, err := newDataCipher()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(gcm, plain)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	outbox := OutboxMessage{
+		ID:          primitive.NewObjectID(),
+		To:          to,
+		Template:    template,
+		Application: application,
+		Message:     msg,
+		Sealed:      sealed,
+		KeyID:       keyID,
+		Status:      OutboxPending,
+		NextAttempt: now,
+		Created:     now,
+	}
+	if err := GetStores().Outbox.Insert(ctx, outbox); err != nil {
+		return nil, err
+	}
+	return &outbox, nil
+}
+
+// outboxBackoff provides the delay before the next attempt, doubling from
+// 30 seconds to a maximum of 2 hours.
+func outboxBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second * time.Duration(math.Pow(2, float64(attempts-1)))
+	if delay > 2*time.Hour || delay <= 0 {
+		delay = 2 * time.Hour
+	}
+	return delay
+}
+
+// claimOutboxMessage marks the next due message as sending, so only one worker
+// delivers it.  A message left sending by a stopped worker is claimed again
+// once its lock expires.
+func claimOutboxMessage(ctx context.Context) (*OutboxMessage, error) {
+	now := time.Now().UTC()
+	return GetStores().Outbox.Claim(ctx, now, now.Add(5*time.Minute))
+}
+
+// openOutboxMessage decrypts the message's rendered email.
+func openOutboxMessage(msg *OutboxMessage) error {
+	if msg.Sealed == "" {
+		return errors.New("message already sent")
+	}
+	gcm, err := getDataCipher(msg.KeyID)
+	if err != nil {
+		return err
+	}
+	plain, err := unseal(gcm, msg.Sealed)
+	if err != nil {
+		return errors.New("message can't be decrypted")
+	}
+	return json.Unmarshal(plain, &msg.Message)
+}
+
+// ProcessOutbox delivers the messages which are due, returning the number
+// delivered.  No more messages are claimed once the context ends, while the
+// one being sent is finished and its outcome recorded.
+func ProcessOutbox(ctx context.Context) (int, error) {
+	transport := GetMailTransport()
+	from := GetSettings().Email.From
+	maxAttempts := GetSettings().Email.MaxAttempts
+
+	count := 0
+	for {
+		if ctx.Err() != nil {
+			return count, nil
+		}
+		msg, err := claimOutboxMessage(ctx)
+		if err == mongo.ErrNoDocuments || ctx.Err() != nil {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		attempts := msg.Attempts + 1
+		now := time.Now().UTC()
+		_, span := StartSpan(ctx, "email.send",
+			attribute.String("email.template", msg.Template),
+			attribute.Int("email.attempt", attempts))
+		err = openOutboxMessage(msg)
+		if err == nil {
+			err = transport.Send(from, msg.To, msg.Message)
+		}
+		EndSpan(span, err)
+		if err != nil {
+			status := OutboxPending
+			if attempts >= maxAttempts {
+				status = OutboxDead
+			}
+			EmailFailureCount.WithLabelValues(strconv.FormatBool(status == OutboxDead)).Inc()
+			msg.Status = status
+			msg.LastError = err.Error()
+			msg.NextAttempt = now.Add(outboxBackoff(attempts))
+		} else {
+			count++
+			msg.Status = OutboxSent
+			msg.Sent = &now
+			msg.LastError = ""
+			msg.Sealed = ""
+			msg.KeyID = ""
+		}
+		msg.Attempts = attempts
+		msg.LockedUntil = nil
+		if err := GetStores().Outbox.Update(context.WithoutCancel(ctx),
+			*msg); err != nil {
+			return count, err
+		}
+	}
+}
+
+// GetOutboxMessages provides the most recent outbox messages, optionally only
+// those of a status.
+func GetOutboxMessages(ctx context.Context, status string,
+	limit int64) ([]OutboxMessage, error) {
+	return GetStores().Outbox.Find(ctx, status, limit)
+}
+
+// RetryOutboxMessage returns a dead-lettered message to the queue.
+func RetryOutboxMessage(ctx context.Context, id string) error {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	msg, err := GetStores().Outbox.GetByID(ctx, oID)
+	if err == mongo.ErrNoDocuments || (err == nil && msg.Status != OutboxDead) {
+		return errors.New("no dead-lettered message found")
+	} else if err != nil {
+		return err
+	}
+	msg.Status = OutboxPending
+	msg.Attempts = 0
+	msg.NextAttempt = time.Now().UTC()
+	return GetStores().Outbox.Update(ctx, *msg)
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, 64 * time.Minute},
+		{9, 2 * time.Hour},
+		{100, 2 * time.Hour},
+	} {
+		if got := outboxBackoff(tc.attempts); got != tc.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+// failingTransport fails every delivery.
+type failingTransport struct{}
+
+func (failingTransport) Send(from string, to []string, msg EmailMessage) error {
+	return context.DeadlineExceeded
+}
+
+func TestProcessOutbox(t *testing.T) {
+	SetStores(NewMemoryStores())
+	ctx := context.Background()
+	SetMailTransport(failingTransport{})
+	defer SetMailTransport(nil)
+
+	queued, err := QueueEmail(ctx, []string{"user@example.com"}, "reset", "",
+		EmailMessage{Subject: "Reset", Text: "token 123456"})
+	if err != nil {
+		t.Fatalf("QueueEmail: %s", err.Error())
+	}
+	if count, _ := ProcessOutbox(ctx); count != 0 {
+		t.Errorf("%d delivered by a failing transport", count)
+	}
+	msg, _ := GetStores().Outbox.GetByID(ctx, queued.ID)
+	if msg.Status != OutboxPending || msg.Attempts != 1 || msg.LockedUntil != nil ||
+		!msg.NextAttempt.After(time.Now()) {
+		t.Fatalf("failed message = %+v", msg)
+	}
+
+	// the retry is due once its backoff has passed
+	msg.NextAttempt = time.Now().UTC()
+	GetStores().Outbox.Update(ctx, *msg)
+	transport := &MemoryTransport{}
+	SetMailTransport(transport)
+	if count, err := ProcessOutbox(ctx); count != 1 || err != nil {
+		t.Fatalf("ProcessOutbox = %d, %v", count, err)
+	}
+	sent := transport.Messages()
+	if len(sent) != 1 || sent[0].Message.Text != "token 123456" {
+		t.Fatalf("sent = %+v", sent)
+	}
+	msg, _ = GetStores().Outbox.GetByID(ctx, queued.ID)
+	if msg.Status != OutboxSent || msg.Sealed != "" {
+		t.Errorf("sent message = %+v", msg)
+	}
+}
@@ -0,0 +1,306 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The default email templates are built into the service.  Each message has
+// an html and a plain text template, with the subject defined in the text
+// template.  Overrides are looked for first in the emailtemplates collection,
+// then in EMAIL_TEMPLATE_DIR, with an application specific template
+// (<dir>/<application>/<name>.html) preferred over a general one.
+//
+//go:embed templates/*
+var defaultTemplates embed.FS
+
+// EmailTemplateNames are the messages the service sends.
+var EmailTemplateNames = []string{
+	"reset", "invite", "emailconfirm", "emailchanged", "passwordexpiry",
+	"securityalert",
+}
+
+// EmailBrand provides the per-application look of a message.
+type EmailBrand struct {
+	Application string `json:"application"`
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	URL         string `json:"url"`
+	Signature   string `json:"signature"`
+}
+
+var emailBrands = map[string]EmailBrand{
+	"scheduler": {
+		Application: "scheduler",
+		Name:        "Scheduler",
+		Color:       "#3f51b5",
+		Signature:   "Scheduler Team",
+	},
+	"metrics": {
+		Application: "metrics",
+		Name:        "Metrics",
+		Color:       "#00796b",
+		Signature:   "Metrics Team",
+	},
+	"default": {
+		Application: "default",
+		Name:        "Authentication",
+		Color:       "#424242",
+		Signature:   "Account Administration",
+	},
+}
+
+// GetEmailBrand provides the brand for the application, with the site URL
+// from the settings (SCHEDULER_URL or METRICS_URL) when set.
+func GetEmailBrand(application string) EmailBrand {
+	application = strings.ToLower(application)
+	brand, ok := emailBrands[application]
+	if !ok {
+		brand = emailBrands["default"]
+	}
+	email := GetSettings().Email
+	switch brand.Application {
+	case "scheduler":
+		brand.URL = email.SchedulerURL
+	case "metrics":
+		brand.URL = email.MetricsURL
+	}
+	return brand
+}
+
+// EmailTemplate is a template override stored in the database.  A blank
+// application applies to all applications.
+type EmailTemplate struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Name        string             `json:"name" bson:"name"`
+	Application string             `json:"application" bson:"application"`
+	HTML        string             `json:"html" bson:"html"`
+	Text        string             `json:"text" bson:"text"`
+	Updated     time.Time          `json:"updated" bson:"updated"`
+}
+
+// EmailMessage is a rendered message ready to send.
+type EmailMessage struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+func getEmailTemplateCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "emailtemplates")
+}
+
+// SaveEmailTemplate stores a database override of a template.
+func SaveEmailTemplate(ctx context.Context, tmpl EmailTemplate) error {
+	if config.DB == nil {
+		return ErrNoDatabase
+	}
+	found := false
+	for _, name := range append(EmailTemplateNames, "layout") {
+		if name == tmpl.Name {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("unknown email template: " + tmpl.Name)
+	}
+	tmpl.Application = strings.ToLower(tmpl.Application)
+	tmpl.Updated = time.Now().UTC()
+
+	filter := bson.M{
+		"name":        tmpl.Name,
+		"application": tmpl.Application,
+	}
+	var old EmailTemplate
+	err := getEmailTemplateCollection().FindOne(ctx, filter).Decode(&old)
+	if err == nil {
+		tmpl.ID = old.ID
+	} else {
+		tmpl.ID = primitive.NewObjectID()
+	}
+	_, err = getEmailTemplateCollection().ReplaceOne(ctx, filter, tmpl,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// loadTemplateSource finds the template text for the name, application and
+// kind ("html" or "txt").
+func loadTemplateSource(ctx context.Context, name, application,
+	kind string) (string, error) {
+	apps := []string{strings.ToLower(application), ""}
+
+	if config.DB != nil {
+		for _, app := range apps {
+			var tmpl EmailTemplate
+			filter := bson.M{"name": name, "application": app}
+			err := getEmailTemplateCollection().FindOne(ctx, filter).Decode(&tmpl)
+			if err == nil {
+				if kind == "html" && tmpl.HTML != "" {
+					return tmpl.HTML, nil
+				} else if kind == "txt" && tmpl.Text != "" {
+					return tmpl.Text, nil
+				}
+			}
+		}
+	}
+
+	if dir := GetSettings().Email.TemplateDir; dir != "" {
+		for _, app := range apps {
+			path := filepath.Join(dir, app, name+"."+kind)
+			if buf, err := os.ReadFile(path); err == nil {
+				return string(buf), nil
+			}
+		}
+	}
+
+	buf, err := defaultTemplates.ReadFile("templates/" + name + "." + kind)
+	if err != nil {
+		return "", fmt.Errorf("email template %s.%s not found", name, kind)
+	}
+	return string(buf), nil
+}
+
+// RenderEmail builds the message from the named templates for the
+// application.  The application's brand is added to the data as Brand and the
+// rendered subject as Subject.
+func RenderEmail(ctx context.Context, name, application string,
+	data map[string]interface{}) (*EmailMessage, error) {
+	values := make(map[string]interface{})
+	for k, v := range data {
+		values[k] = v
+	}
+	values["Brand"] = GetEmailBrand(application)
+
+	layoutText, err := loadTemplateSource(ctx, "layout", application, "txt")
+	if err != nil {
+		return nil, err
+	}
+	bodyText, err := loadTemplateSource(ctx, name, application, "txt")
+	if err != nil {
+		return nil, err
+	}
+	textTmpl, err := texttemplate.New(name).Parse(bodyText)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := textTmpl.Parse(layoutText); err != nil {
+		return nil, err
+	}
+	if textTmpl.Lookup("subject") == nil {
+		return nil, fmt.Errorf("email template %s has no subject", name)
+	}
+
+	var subject, text bytes.Buffer
+	if err := textTmpl.ExecuteTemplate(&subject, "subject", values); err != nil {
+		return nil, err
+	}
+	values["Subject"] = strings.TrimSpace(subject.String())
+	if err := textTmpl.ExecuteTemplate(&text, name, values); err != nil {
+		return nil, err
+	}
+
+	layoutHTML, err := loadTemplateSource(ctx, "layout", application, "html")
+	if err != nil {
+		return nil, err
+	}
+	bodyHTML, err := loadTemplateSource(ctx, name, application, "html")
+	if err != nil {
+		return nil, err
+	}
+	htmlTmpl, err := htmltemplate.New(name).Parse(bodyHTML)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := htmlTmpl.Parse(layoutHTML); err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	if err := htmlTmpl.ExecuteTemplate(&html, name, values); err != nil {
+		return nil, err
+	}
+
+	return &EmailMessage{
+		Subject: values["Subject"].(string),
+		HTML:    html.String(),
+		Text:    text.String(),
+	}, nil
+}
+
+// SendTemplateEmail renders the named message for the application and queues
+// it in the outbox for delivery to the addresses given.
+func SendTemplateEmail(ctx context.Context, to []string, name, application string,
+	data map[string]interface{}) error {
+	ctx, span := StartSpan(ctx, "email.template",
+		attribute.String("email.template", name))
+	msg, err := RenderEmail(ctx, name, application, data)
+	if err == nil {
+		_, err = QueueEmail(ctx, to, name, application, *msg)
+	}
+	EndSpan(span, err)
+	return err
+}
+
+// buildMultipartMail provides the MIME encoded multipart/alternative message,
+// plain text first so mail readers prefer the html part.
+func buildMultipartMail(from string, to []string, msg EmailMessage) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n",
+		writer.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
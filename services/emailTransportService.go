@@ -0,0 +1,117 @@
+package services
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailTransport delivers a rendered message.  The outbox worker uses the
+// transport chosen by EMAIL_TRANSPORT: "smtp" (default), "file" to write each
+// message into EMAIL_FILE_DIR, or "memory" for tests and local development.
+type MailTransport interface {
+	Send(from string, to []string, msg EmailMessage) error
+}
+
+// SMTPTransport sends through the SMTP server, without authentication.
+type SMTPTransport struct {
+	Server string
+	Port   string
+}
+
+func (t *SMTPTransport) Send(from string, to []string, msg EmailMessage) error {
+	message, err := buildMultipartMail(from, to, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(t.Server+":"+t.Port, nil, from, to, message)
+}
+
+// FileTransport writes each message as an .eml file in the directory.
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Send(from string, to []string, msg EmailMessage) error {
+	message, err := buildMultipartMail(from, to, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(t.Dir, 0750); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"),
+		strings.ReplaceAll(strings.Join(to, "_"), "@", "_at_"))
+	return os.WriteFile(filepath.Join(t.Dir, name), message, 0640)
+}
+
+// SentMail is a message delivered to a MemoryTransport.
+type SentMail struct {
+	From    string
+	To      []string
+	Message EmailMessage
+	Sent    time.Time
+}
+
+// MemoryTransport keeps delivered messages in memory.
+type MemoryTransport struct {
+	mutex    sync.Mutex
+	messages []SentMail
+}
+
+func (t *MemoryTransport) Send(from string, to []string, msg EmailMessage) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.messages = append(t.messages, SentMail{
+		From:    from,
+		To:      to,
+		Message: msg,
+		Sent:    time.Now().UTC(),
+	})
+	return nil
+}
+
+// Messages provides a copy of the messages delivered so far.
+func (t *MemoryTransport) Messages() []SentMail {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]SentMail(nil), t.messages...)
+}
+
+var (
+	transportMutex sync.Mutex
+	mailTransport  MailTransport
+)
+
+// GetMailTransport provides the configured transport, created on first use.
+func GetMailTransport() MailTransport {
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+	if mailTransport == nil {
+		switch strings.ToLower(GetSettings().Email.Transport) {
+		case "file":
+			mailTransport = &FileTransport{
+				Dir: GetSettings().Email.FileDir,
+			}
+		case "memory":
+			mailTransport = &MemoryTransport{}
+		default:
+			mailTransport = &SMTPTransport{
+				Server: GetSettings().Email.SMTPServer,
+				Port:   GetSettings().Email.SMTPPort,
+			}
+		}
+	}
+	return mailTransport
+}
+
+// SetMailTransport replaces the transport, used for tests.
+func SetMailTransport(transport MailTransport) {
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+	mailTransport = transport
+}
@@ -4,13 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 
-	"github.com/erneap/go-models/config"
 	"github.com/erneap/go-models/employees"
 	"github.com/erneap/go-models/users"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -22,57 +19,47 @@ import (
 // Create Employee
 // Most employees will have a log in account to allow them to view the
 // schedule data.  So a comparison of their possible authentication account is
-// made to ensure their object ID is the same.
-func CreateEmployee(emp employees.Employee, passwd, workgroup, teamID,
-	siteid string) (*employees.Employee, error) {
-	userCol := config.GetCollection(config.DB, "authenticate", "users")
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
+// made to ensure their object ID is the same.  New accounts are sent an
+// invitation to set their own password.
+func CreateEmployee(ctx context.Context, emp employees.Employee, workgroup,
+	teamID, siteid,
+	createdBy string) (*employees.Employee, error) {
+	empStore := GetStores().Employees
 	teamid, err := primitive.ObjectIDFromHex(teamID)
 	if err != nil {
 		return nil, err
 	}
 
-	filter := bson.M{
-		"name.firstName": emp.Name.FirstName,
-		"name.lastName":  emp.Name.LastName,
-		"team":           teamid,
-	}
-
 	// first check to see of an employee already exists for this first and last
-	// name.  If present, change filter to include middle if not blank, but if
+	// name.  If present, check again including middle if not blank, but if
 	// middle is blank, return old employee record
-	var tEmp employees.Employee
-	err = empCol.FindOne(context.TODO(), filter).Decode(&tEmp)
+	_, err = empStore.GetInTeam(ctx, teamid, emp.Name.FirstName, "", emp.Name.LastName)
 	if err == nil || err != mongo.ErrNoDocuments {
 		if emp.Name.MiddleName == "" {
 			return &emp, nil
 		}
-		filter = bson.M{
-			"name.firstName":  emp.Name.FirstName,
-			"name.middleName": emp.Name.MiddleName,
-			"name.lastName":   emp.Name.LastName,
-			"team":            teamid,
-		}
-
-		err = empCol.FindOne(context.TODO(), filter).Decode(&emp)
-		if err == nil || err != mongo.ErrNoDocuments {
+		tEmp, err := empStore.GetInTeam(ctx, teamid, emp.Name.FirstName,
+			emp.Name.MiddleName, emp.Name.LastName)
+		if err == nil {
+			return tEmp, nil
+		} else if err != mongo.ErrNoDocuments {
 			return &emp, nil
 		}
 	}
 
-	// check user collection for new employee
-	filter = bson.M{
-		"firstName": emp.Name.FirstName,
-		"lastName":  emp.Name.LastName,
+	// check user collection for new employee, by email address (ignoring case)
+	// when provided, since names aren't unique.
+	var user *users.User
+	if emp.Email != "" {
+		user, err = GetStores().Users.GetByEmail(ctx, emp.Email)
+	} else {
+		user, err = GetStores().Users.GetByName(ctx, emp.Name.FirstName, emp.Name.LastName)
 	}
-
-	var user users.User
-
-	err = userCol.FindOne(context.TODO(), filter).Decode(&user)
 	if err == mongo.ErrNoDocuments {
 		emp.ID = primitive.NewObjectID()
-		// create user record with provided password.
-		user = users.User{
+		// create user record with an unusable password until the invitation
+		// is accepted.
+		newUser := users.User{
 			ID:           emp.ID,
 			EmailAddress: emp.Email,
 			FirstName:    emp.Name.FirstName,
@@ -83,66 +70,64 @@ func CreateEmployee(emp employees.Employee, passwd, workgroup, teamID,
 			},
 		}
 		if workgroup != "" {
-			user.Workgroups = append(user.Workgroups, workgroup)
+			newUser.Workgroups = append(newUser.Workgroups, workgroup)
 		}
-		user.SetPassword(passwd)
-		userCol.InsertOne(context.TODO(), user)
-	} else {
+		newUser.SetPassword(RandomToken(32))
+		if err = GetStores().Users.Insert(ctx, newUser); err != nil {
+			return nil, err
+		}
+		if _, err = InviteUser(ctx, newUser, "scheduler", createdBy); err != nil {
+			// the user can't be used without the invitation, so isn't kept
+			if rerr := RemoveInvitedUser(ctx, newUser.ID); rerr != nil {
+				return nil, fmt.Errorf("%s, user not removed: %s", err.Error(),
+					rerr.Error())
+			}
+			return nil, err
+		}
+	} else if user != nil {
 		emp.ID = user.ID
 	}
 
 	emp.TeamID = teamid
 	emp.SiteID = siteid
 
-	empCol.InsertOne(context.TODO(), emp)
+	empStore.Insert(ctx, emp)
 	return &emp, nil
 }
 
-func GetEmployee(id string) (*employees.Employee, error) {
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
-	userCol := config.GetCollection(config.DB, "authenticate", "users")
+// getEmployeeUser provides the employee's user account, blank when they have
+// none.
+func getEmployeeUser(ctx context.Context, id primitive.ObjectID) *users.User {
+	user, err := GetStores().Users.GetByID(ctx, id.Hex())
+	if err != nil {
+		return &users.User{}
+	}
+	return user
+}
 
+func GetEmployee(ctx context.Context, id string) (*employees.Employee, error) {
 	oEmpID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return nil, err
 	}
 
-	filter := bson.M{
-		"_id": oEmpID,
-	}
-
-	var emp employees.Employee
-	err = empCol.FindOne(context.TODO(), filter).Decode(&emp)
+	emp, err := GetStores().Employees.GetByID(ctx, oEmpID)
 	if err != nil {
-		fmt.Println(err.Error())
+		Logger.Debug("GetEmployee: employee not found", "id", id, "error", err)
 		return nil, err
 	}
-	var user users.User
-	userCol.FindOne(context.TODO(), filter).Decode(&user)
-	emp.User = &user
-	return &emp, nil
+	emp.User = getEmployeeUser(ctx, emp.ID)
+	return emp, nil
 }
 
-func GetEmployeeByName(first, middle, last string) (*employees.Employee, error) {
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
-	userCol := config.GetCollection(config.DB, "authenticate", "users")
+func GetEmployeeByName(ctx context.Context, first, middle,
+	last string) (*employees.Employee, error) {
+	empStore := GetStores().Employees
 
-	filter := bson.M{
-		"name.firstname":  first,
-		"name.middlename": middle,
-		"name.lastname":   last,
-	}
-
-	var emp employees.Employee
-	err := empCol.FindOne(context.TODO(), filter).Decode(&emp)
+	emp, err := empStore.GetByName(ctx, first, middle, last)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			filter = bson.M{
-				"name.firstname":  first,
-				"name.middlename": middle[:1],
-				"name.lastname":   last,
-			}
-			err = empCol.FindOne(context.TODO(), filter).Decode(&emp)
+			emp, err = empStore.GetByName(ctx, first, middle[:1], last)
 			if err != nil {
 				return nil, err
 			}
@@ -150,113 +135,48 @@ func GetEmployeeByName(first, middle, last string) (*employees.Employee, error)
 			return nil, err
 		}
 	}
-	var user users.User
-	filter = bson.M{
-		"_id": emp.ID,
-	}
-	userCol.FindOne(context.TODO(), filter).Decode(&user)
-	emp.User = &user
+	emp.User = getEmployeeUser(ctx, emp.ID)
 
-	return &emp, nil
+	return emp, nil
 }
 
-func GetEmployees(teamid, siteid string) ([]employees.Employee, error) {
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
-	userCol := config.GetCollection(config.DB, "authenticate", "users")
-
+func GetEmployees(ctx context.Context, teamid,
+	siteid string) ([]employees.Employee, error) {
 	oTID, _ := primitive.ObjectIDFromHex(teamid)
-	filter := bson.M{
-		"team": oTID,
-		"site": siteid,
-	}
-
-	var employees []employees.Employee
-
-	cursor, err := empCol.Find(context.TODO(), filter)
+	emps, err := GetStores().Employees.GetAll(ctx, oTID, siteid)
 	if err != nil {
-		return employees[:0], err
+		return emps, err
 	}
 
-	if err = cursor.All(context.TODO(), &employees); err != nil {
-		log.Println(err)
-	}
-
-	for i, emp := range employees {
-		filter = bson.M{
-			"_id": emp.ID,
-		}
-		var user users.User
-		userCol.FindOne(context.TODO(), filter).Decode(&user)
-		emp.User = &user
-		employees[i] = emp
+	for i, emp := range emps {
+		emp.User = getEmployeeUser(ctx, emp.ID)
+		emps[i] = emp
 	}
 
-	return employees, nil
+	return emps, nil
 }
 
-func GetEmployeesForTeam(teamid string) ([]employees.Employee, error) {
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
-	userCol := config.GetCollection(config.DB, "authenticate", "users")
-
-	oTID, _ := primitive.ObjectIDFromHex(teamid)
-	filter := bson.M{
-		"team": oTID,
-	}
-
-	var employees []employees.Employee
-
-	cursor, err := empCol.Find(context.TODO(), filter)
-	if err != nil {
-		return employees[:0], err
-	}
-
-	if err = cursor.All(context.TODO(), &employees); err != nil {
-		log.Println(err)
-	}
-
-	for i, emp := range employees {
-		filter = bson.M{
-			"_id": emp.ID,
-		}
-		var user users.User
-		userCol.FindOne(context.TODO(), filter).Decode(&user)
-		emp.User = &user
-		employees[i] = emp
-	}
-
-	return employees, nil
+func GetEmployeesForTeam(ctx context.Context,
+	teamid string) ([]employees.Employee, error) {
+	return GetEmployees(ctx, teamid, "")
 }
 
-func UpdateEmployee(emp *employees.Employee) error {
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
-
-	filter := bson.M{
-		"_id": emp.ID,
-	}
-
-	_, err := empCol.ReplaceOne(context.TODO(), filter, emp)
-	return err
+func UpdateEmployee(ctx context.Context, emp *employees.Employee) error {
+	return GetStores().Employees.Update(ctx, *emp)
 }
 
-func DeleteEmployee(empID string) error {
-	empCol := config.GetCollection(config.DB, "scheduler", "employees")
-	userCol := config.GetCollection(config.DB, "authenticate", "users")
-
+func DeleteEmployee(ctx context.Context, empID, deletedBy string) error {
 	oEmpID, _ := primitive.ObjectIDFromHex(empID)
-	filter := bson.M{
-		"_id": oEmpID,
-	}
 
-	result, err := empCol.DeleteOne(context.TODO(), filter)
+	deleted, err := GetStores().Employees.Delete(ctx, oEmpID)
 	if err != nil {
 		return err
 	}
-	if result.DeletedCount <= 0 {
+	if !deleted {
 		return errors.New("employee not found")
 	}
 
-	var user users.User
-	err = userCol.FindOne(context.TODO(), filter).Decode(&user)
+	user, err := GetStores().Users.GetByID(ctx, oEmpID.Hex())
 	if err == nil {
 		found := false
 		for i := len(user.Workgroups) - 1; i >= 0; i-- {
@@ -267,11 +187,14 @@ func DeleteEmployee(empID string) error {
 			}
 		}
 		if found && len(user.Workgroups) > 0 {
-			userCol.UpdateOne(context.TODO(), filter, user)
+			GetStores().Users.Update(ctx, *user)
 		} else {
-			_, err = userCol.DeleteOne(context.TODO(), filter)
+			// the user record is only deactivated, so it can be restored along
+			// with its history until the retention period passes.
+			_, err = DeactivateUser(ctx, user.ID.Hex(), deletedBy)
 			if err != nil {
-				fmt.Println(err.Error())
+				Logger.Error("DeleteEmployee: DeactivateUser problem",
+					"userid", user.ID.Hex(), "error", err)
 			}
 		}
 	}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/erneap/go-models/employees"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCreateEmployeeInviteFails(t *testing.T) {
+	SetStores(NewMemoryStores())
+	ctx := context.Background()
+	// without a security key the invitation can't be queued
+	previous := GetSettings()
+	defer currentSettings.Store(previous)
+	settings := *previous
+	settings.Security.SecurityKey = ""
+	currentSettings.Store(&settings)
+
+	var emp employees.Employee
+	emp.Name.FirstName = "New"
+	emp.Name.LastName = "Employee"
+	emp.Email = "new.employee@example.com"
+	_, err := CreateEmployee(ctx, emp, "", primitive.NewObjectID().Hex(), "site",
+		"admin")
+	if err == nil {
+		t.Fatal("employee created without an invitation")
+	}
+	user, err := GetStores().Users.GetByEmail(ctx, emp.Email)
+	if err != mongo.ErrNoDocuments {
+		t.Fatalf("uninvited user kept: %+v, %v", user, err)
+	}
+	if invites := GetStores().Invitations.(*MemoryInvitationStore).invites; len(invites) != 0 {
+		t.Errorf("invitations kept: %+v", invites)
+	}
+}
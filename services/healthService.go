@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+// HealthCheck is the result of one readiness check.  A failed check which
+// isn't required only warns.  The readiness endpoint is unauthenticated, so
+// the reason a check failed is logged rather than reported.
+type HealthCheck struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Required   bool   `json:"required"`
+	DurationMS int64  `json:"durationMs"`
+}
+
+// HealthReport is the overall readiness with its checks.
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+	Time   time.Time     `json:"time"`
+}
+
+// requiredIndexes are the indexes, by collection, which the service relies on
+// for correctness rather than just speed.
+var requiredIndexes = map[string]string{
+	"audit": "seq_unique",
+}
+
+// emailIndex is the unique email index, which can't be built while duplicate
+// users exist.  The service stays ready without it, so the duplicates can be
+// merged through the service.
+var emailIndex = map[string]string{
+	"users": "emailAddress_unique_ci",
+}
+
+// CheckReadiness runs the dependency checks: the MongoDB connection, the
+// required indexes, the token signing keys and, when sending by SMTP, that the
+// mail server accepts connections.
+func CheckReadiness(ctx context.Context) HealthReport {
+	report := HealthReport{
+		Status: HealthOK,
+		Time:   time.Now().UTC(),
+	}
+	run := func(name string, required bool, check func(context.Context) error) {
+		start := time.Now()
+		checkCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+		result := HealthCheck{Name: name, Status: HealthOK, Required: required}
+		if err := check(checkCtx); err != nil {
+			Logger.Warn("readiness check failed", "check", name, "error", err)
+			result.Status = HealthWarn
+			if required {
+				result.Status = HealthFail
+				report.Status = HealthFail
+			} else if report.Status == HealthOK {
+				report.Status = HealthWarn
+			}
+		}
+		result.DurationMS = time.Since(start).Milliseconds()
+		report.Checks = append(report.Checks, result)
+	}
+
+	run("mongodb", true, checkMongo)
+	run("indexes", true, func(ctx context.Context) error {
+		return checkIndexes(ctx, requiredIndexes)
+	})
+	run("emailindex", false, func(ctx context.Context) error {
+		return checkIndexes(ctx, emailIndex)
+	})
+	run("signingkeys", true, checkSigningKeys)
+	if _, ok := GetMailTransport().(*SMTPTransport); ok {
+		run("smtp", false, checkSMTP)
+	}
+	return report
+}
+
+func checkMongo(ctx context.Context) error {
+	if config.DB == nil {
+		return errors.New("not connected")
+	}
+	return config.DB.Ping(ctx, nil)
+}
+
+func checkIndexes(ctx context.Context, wanted map[string]string) error {
+	if config.DB == nil {
+		return errors.New("not connected")
+	}
+	for collection, index := range wanted {
+		col := config.GetCollection(config.DB, "authenticate", collection)
+		cursor, err := col.Indexes().List(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %s", collection, err.Error())
+		}
+		var indexes []bson.M
+		if err := cursor.All(ctx, &indexes); err != nil {
+			return fmt.Errorf("%s: %s", collection, err.Error())
+		}
+		found := false
+		for _, idx := range indexes {
+			if idx["name"] == index {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: index %s missing", collection, index)
+		}
+	}
+	return nil
+}
+
+func checkSigningKeys(ctx context.Context) error {
+	if GetSettings().Security.JWTSecret == "" {
+		return errors.New("JWT_SECRET not set")
+	}
+	if GetSettings().Audit.SigningKey == "" {
+		return errors.New("AUDIT_SIGNING_KEY not set")
+	}
+	return nil
+}
+
+func checkSMTP(ctx context.Context) error {
+	transport := GetMailTransport().(*SMTPTransport)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp",
+		net.JoinHostPort(transport.Server, transport.Port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
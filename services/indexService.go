@@ -0,0 +1,49 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureIndexes creates the indexes the service relies on.  Creating an index
+// which already exists is a no-op, so this is run periodically from startup,
+// and an index which couldn't be created, such as when MongoDB was down, is
+// created once it can be.  The unique email index can't be built until
+// existing duplicates are merged, which doesn't stop the service.  Whether
+// each group of indexes exists is given by the auth_index_ready metric and
+// the readiness checks.
+func EnsureIndexes(ctx context.Context) error {
+	if config.DB == nil {
+		return ErrNoDatabase
+	}
+	var problems []error
+	ensure := func(index string, create func(context.Context) error) {
+		err := create(ctx)
+		IndexReady.WithLabelValues(index).Set(1)
+		if err != nil {
+			IndexReady.WithLabelValues(index).Set(0)
+			problems = append(problems, fmt.Errorf("%s: %s", index, err.Error()))
+		}
+	}
+
+	ensure("users_email", func(ctx context.Context) error {
+		_, err := getUserCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "emailAddress", Value: 1}},
+			Options: options.Index().
+				SetName("emailAddress_unique_ci").
+				SetUnique(true).
+				SetCollation(emailCollation),
+		})
+		return err
+	})
+	ensure("audit", ensureAuditIndexes)
+	ensure("audit_chain", ensureAuditChainIndexes)
+	ensure("audit_rollups", ensureAuditRetentionIndexes)
+	return errors.Join(problems...)
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Invitation is the outstanding request for a new user to set their own
+// password.  Only a hash of the signed token is stored, and each resend
+// replaces it, so only the latest link works.
+type Invitation struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	EmailAddress string             `json:"emailAddress" bson:"emailAddress"`
+	Application  string             `json:"application" bson:"application"`
+	TokenHash    string             `json:"-" bson:"tokenHash"`
+	Created      time.Time          `json:"created" bson:"created"`
+	CreatedBy    string             `json:"createdBy" bson:"createdBy"`
+	Expires      time.Time          `json:"expires" bson:"expires"`
+	Sent         int                `json:"sent" bson:"sent"`
+	Revoked      bool               `json:"revoked" bson:"revoked"`
+	Accepted     *time.Time         `json:"accepted,omitempty" bson:"accepted,omitempty"`
+}
+
+func getInvitationCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "invitations")
+}
+
+func getInviteSecret() []byte {
+	secret := GetSettings().Security.InviteSecret
+	if secret == "" {
+		secret = GetSettings().Security.JWTSecret
+	}
+	return []byte(secret)
+}
+
+// signInviteToken provides a token of the form
+// base64(userid.expires.nonce).signature.
+func signInviteToken(id primitive.ObjectID, expires time.Time) string {
+	payload := fmt.Sprintf("%s.%d.%s", id.Hex(), expires.Unix(), RandomToken(16))
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, getInviteSecret())
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyInviteToken checks the token signature and expiration and provides the
+// user ID it was issued for.
+func verifyInviteToken(token string) (primitive.ObjectID, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return primitive.NilObjectID, errors.New("malformed invitation token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return primitive.NilObjectID, errors.New("malformed invitation token")
+	}
+	mac := hmac.New(sha256.New, getInviteSecret())
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return primitive.NilObjectID, errors.New("invalid invitation token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return primitive.NilObjectID, errors.New("malformed invitation token")
+	}
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 3 {
+		return primitive.NilObjectID, errors.New("malformed invitation token")
+	}
+	exp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return primitive.NilObjectID, errors.New("malformed invitation token")
+	}
+	if time.Now().UTC().After(time.Unix(exp, 0)) {
+		return primitive.NilObjectID, errors.New("invitation expired")
+	}
+	return primitive.ObjectIDFromHex(fields[0])
+}
+
+// InviteUser places the user in pending activation and emails them a signed
+// link to set their own password.  Inviting a user again replaces the previous
+// invitation.  A disabled or expired account isn't invited, so an invitation
+// can't undo an administrator's decision.
+func InviteUser(ctx context.Context, user users.User, application,
+	createdBy string) (*Invitation, error) {
+	status, err := GetAccountStatus(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if status.Status != StatusActive && status.Status != StatusPending {
+		return nil, errors.New("account " + status.Status)
+	}
+	status.Status = StatusPending
+	status.Reason = "invitation sent"
+	status.UpdatedBy = createdBy
+	if err := SetAccountStatus(ctx, *status); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	invite := Invitation{
+		ID:           user.ID,
+		EmailAddress: user.EmailAddress,
+		Application:  application,
+		Created:      now,
+		CreatedBy:    createdBy,
+		Expires:      now.Add(time.Hour * time.Duration(GetSettings().Users.InviteExpiryHours)),
+	}
+	old, err := GetStores().Invitations.Get(ctx, user.ID)
+	if err == nil {
+		invite.Sent = old.Sent
+	}
+
+	token := signInviteToken(user.ID, invite.Expires)
+	invite.TokenHash = hashToken(token)
+	invite.Sent++
+
+	if err := GetStores().Invitations.Save(ctx, invite); err != nil {
+		return nil, err
+	}
+
+	link := fmt.Sprintf("%s?token=%s",
+		GetSettings().Users.InviteURL, token)
+	err = SendTemplateEmail(ctx, []string{user.EmailAddress}, "invite", application,
+		map[string]interface{}{
+			"Link":    link,
+			"Expires": invite.Expires.Format("01/02/06 15:04") + " UTC",
+		})
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// ResendInvitation issues a new invitation for a user who hasn't accepted the
+// previous one.  A revoked invitation stays revoked.
+func ResendInvitation(ctx context.Context, id, createdBy string) (*Invitation, error) {
+	user, err := GetStores().Users.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	invite, err := GetInvitation(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if invite.Accepted != nil {
+		return nil, errors.New("invitation already accepted")
+	}
+	if invite.Revoked {
+		return nil, errors.New("invitation revoked")
+	}
+	return InviteUser(ctx, *user, invite.Application, createdBy)
+}
+
+func GetInvitation(ctx context.Context, id primitive.ObjectID) (*Invitation, error) {
+	return GetStores().Invitations.Get(ctx, id)
+}
+
+func RevokeInvitation(ctx context.Context, id string) error {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	invite, err := GetInvitation(ctx, oID)
+	if err == mongo.ErrNoDocuments || (err == nil && invite.Accepted != nil) {
+		return errors.New("no outstanding invitation")
+	} else if err != nil {
+		return err
+	}
+	invite.Revoked = true
+	return GetStores().Invitations.Save(ctx, *invite)
+}
+
+// AcceptInvitation sets the user's password from a valid invitation token and
+// activates the pending account.
+func AcceptInvitation(ctx context.Context, token, passwd string) (*users.User, error) {
+	id, err := verifyInviteToken(token)
+	if err != nil {
+		return nil, err
+	}
+	invite, err := GetInvitation(ctx, id)
+	if err != nil {
+		return nil, errors.New("invitation not found")
+	}
+	if invite.Revoked {
+		return nil, errors.New("invitation revoked")
+	}
+	if invite.Accepted != nil {
+		return nil, errors.New("invitation already accepted")
+	}
+	if !hmac.Equal([]byte(invite.TokenHash), []byte(hashToken(token))) {
+		return nil, errors.New("invitation superseded")
+	}
+	if err := ValidatePassword(passwd); err != nil {
+		return nil, err
+	}
+
+	user, err := GetStores().Users.GetByID(ctx, id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	SetUserPassword(ctx, user, passwd)
+	user.BadAttempts = 0
+	if err := GetStores().Users.Update(ctx, *user); err != nil {
+		return nil, err
+	}
+
+	// only a pending account is activated, one disabled since the
+	// invitation was sent stays disabled
+	status, err := GetAccountStatus(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if status.Status == StatusPending {
+		status.Status = StatusActive
+		status.Reason = "invitation accepted"
+		status.UpdatedBy = user.ID.Hex()
+		if err := SetAccountStatus(ctx, *status); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	invite.Accepted = &now
+	if err := GetStores().Invitations.Save(ctx, *invite); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RemoveInvitedUser removes a new user whose invitation couldn't be sent,
+// with the invitation and account status, so no account is left behind that
+// nobody can use.
+func RemoveInvitedUser(ctx context.Context, id primitive.ObjectID) error {
+	if err := GetStores().Users.Delete(ctx, id.Hex()); err != nil {
+		return err
+	}
+	if err := GetStores().Invitations.Delete(ctx, id); err != nil {
+		return err
+	}
+	return GetStores().Accounts.DeleteStatus(ctx, id)
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	jobsContext, stopJobs = context.WithCancel(context.Background())
+	jobsRunning           sync.WaitGroup
+)
+
+// RunPeriodically starts a background job which is run once immediately and
+// then at every interval until StopJobs is called.  Each run is traced and
+// given a context which ends when the jobs are stopped.  Errors are logged,
+// but never stop the job.
+func RunPeriodically(name string, interval time.Duration,
+	job func(ctx context.Context) error) {
+	jobsRunning.Add(1)
+	go func() {
+		defer jobsRunning.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ctx, span := StartSpan(jobsContext, "job.run",
+				attribute.String("job.name", name))
+			err := job(ctx)
+			EndSpan(span, err)
+			if err != nil {
+				Logger.Error("background job problem", "job", name, "error", err)
+			}
+			select {
+			case <-jobsContext.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RunInBackground runs the function in its own goroutine, which StopJobs
+// waits for.
+func RunInBackground(fn func()) {
+	jobsRunning.Add(1)
+	go func() {
+		defer jobsRunning.Done()
+		fn()
+	}()
+}
+
+// StopJobs stops the periodic jobs and waits for those running, and any
+// background work, to finish or for the context to end.
+func StopJobs(ctx context.Context) error {
+	stopJobs()
+	done := make(chan struct{})
+	go func() {
+		jobsRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
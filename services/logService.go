@@ -6,14 +6,24 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// AddLogEntry records a free-text message as an audit event, with the title
+// as its action and the portion kept apart from the event's application.  It
+// is kept for operational problems, such as a failed database read, which new
+// code records with CategoryError.  Requests for a user's account are recorded
+// with AuditUser or AuditFailure, so the action and target are typed.
 func AddLogEntry(c *gin.Context, portion, category, title, msg string) error {
-	empID := svcs.GetRequestor(c)
-	emp, _ := GetEmployee(empID)
-	return svcs.AddLogEntry2(portion, category, title, msg, emp)
+	return Audit(c, AuditEvent{
+		Action:   title,
+		Category: category,
+		Portion:  portion,
+		Message:  msg,
+	})
 }
 
+// GetLogEntries provides the entries written to the application log before
+// the audit trail replaced it.
 func GetLogEntries(c *gin.Context, portion string, year int) ([]logs.LogEntry2, error) {
 	empID := svcs.GetRequestor(c)
-	emp, _ := GetEmployee(empID)
+	emp, _ := GetEmployee(c.Request.Context(), empID)
 	return svcs.GetLogEntries2(portion, year, emp)
 }
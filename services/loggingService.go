@@ -0,0 +1,115 @@
+package services
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logger writes the service's structured JSON log to stdout.  Attributes named
+// as secrets, such as password or token, are redacted.  It logs at the info
+// level until InitLogging sets the level from the settings.
+var Logger = newLogger("")
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// InitLogging sets the log level from LOGLEVEL (debug, info, warn or error,
+// or 0 to 3 in the same order as the shared go-models packages use) and sends
+// the standard library and gin logs through the structured log.
+func InitLogging() {
+	Logger = newLogger(GetSettings().Logging.Level)
+	slog.SetDefault(Logger)
+	gin.DefaultWriter = slog.NewLogLogger(Logger.Handler(), slog.LevelInfo).Writer()
+	gin.DefaultErrorWriter = slog.NewLogLogger(Logger.Handler(), slog.LevelError).Writer()
+}
+
+// parseLogLevel provides the slog level for the LOGLEVEL name or number, a
+// blank level being info.
+func parseLogLevel(level string) (slog.Level, error) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	switch level {
+	case "debug", "0":
+		return slog.LevelDebug, nil
+	case "info", "1", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning", "2":
+		return slog.LevelWarn, nil
+	case "error", "3":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("must be debug, info, warn, error or 0 to 3, not %q", level)
+}
+
+func newLogger(level string) *slog.Logger {
+	lvl, _ := parseLogLevel(level)
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindString && isSecretField(a.Key) {
+		a.Value = slog.StringValue(RedactValue(a.Key, a.Value.String()))
+	}
+	return a
+}
+
+// RequestLogger provides the logger for the request, which adds its request
+// ID, and trace ID when traced, to every line.
+func RequestLogger(c *gin.Context) *slog.Logger {
+	if c == nil {
+		return Logger
+	}
+	logger := Logger.With("request_id", GetRequestID(c))
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+// RequestID is middleware giving each request a correlation ID, taken from
+// the X-Request-ID header when the caller provides a usable one.  The ID is
+// returned in the response's X-Request-ID header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = RandomToken(16)
+		}
+		c.Set("requestid", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// AccessLog is middleware logging each request once it completes, replacing
+// gin's text logger.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+		RequestLogger(c).Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+			"user_agent", c.Request.UserAgent(),
+			"size", c.Writer.Size())
+	}
+}
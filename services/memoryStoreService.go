@@ -0,0 +1,829 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erneap/go-models/employees"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NewMemoryStores provides empty stores kept in memory, for running the
+// handlers without a database.  Nothing is kept when the process exits.
+func NewMemoryStores() *Stores {
+	return &Stores{
+		Users:     &MemoryUserStore{users: make(map[primitive.ObjectID]users.User)},
+		Employees: &MemoryEmployeeStore{emps: make(map[primitive.ObjectID]employees.Employee)},
+		Audit:     &MemoryAuditStore{},
+		Sessions:  &MemorySessionStore{devices: make(map[string]KnownDevice)},
+		Accounts: &MemoryAccountStore{
+			statuses: make(map[primitive.ObjectID]AccountStatus),
+			deleted:  make(map[primitive.ObjectID]DeletedUser),
+			changes:  make(map[primitive.ObjectID]PasswordChangeToken),
+			notices:  make(map[primitive.ObjectID]ExpiryNotice),
+		},
+		Invitations: &MemoryInvitationStore{
+			invites: make(map[primitive.ObjectID]Invitation),
+		},
+		EmailChanges: &MemoryEmailChangeStore{
+			changes: make(map[primitive.ObjectID]EmailChange),
+		},
+		Notifications: &MemoryNotificationStore{
+			contacts: make(map[primitive.ObjectID]ContactPreference),
+			alerts:   make(map[string]AlertSetting),
+		},
+		Outbox: &MemoryOutboxStore{},
+	}
+}
+
+// MemoryUserStore keeps the users in memory, with email addresses unique
+// regardless of case as in MongoDB.
+type MemoryUserStore struct {
+	mutex sync.Mutex
+	users map[primitive.ObjectID]users.User
+}
+
+func (s *MemoryUserStore) find(match func(users.User) bool) (*users.User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, user := range s.users {
+		if match(user) {
+			found := CopyUser(user)
+			return &found, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *MemoryUserStore) GetByID(ctx context.Context, id string) (*users.User, error) {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.find(func(user users.User) bool { return user.ID == oID })
+}
+
+func (s *MemoryUserStore) GetByEmail(ctx context.Context,
+	email string) (*users.User, error) {
+	email = strings.TrimSpace(email)
+	return s.find(func(user users.User) bool {
+		return strings.EqualFold(user.EmailAddress, email)
+	})
+}
+
+func (s *MemoryUserStore) GetByName(ctx context.Context, first,
+	last string) (*users.User, error) {
+	return s.find(func(user users.User) bool {
+		return user.FirstName == first && user.LastName == last
+	})
+}
+
+func (s *MemoryUserStore) GetAll(ctx context.Context) ([]users.User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	all := []users.User{}
+	for _, user := range s.users {
+		all = append(all, CopyUser(user))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID.Hex() < all[j].ID.Hex() })
+	return all, nil
+}
+
+func (s *MemoryUserStore) Create(ctx context.Context, email, first, middle, last,
+	passwd string) (*users.User, error) {
+	user := users.User{
+		ID:           primitive.NewObjectID(),
+		EmailAddress: email,
+		FirstName:    first,
+		MiddleName:   middle,
+		LastName:     last,
+	}
+	user.SetPassword(passwd)
+	if err := s.Insert(ctx, user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MemoryUserStore) Insert(ctx context.Context, user users.User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[user.ID]; ok {
+		return errors.New("duplicate user id")
+	}
+	return s.save(user)
+}
+
+// Update replaces the user, doing nothing when there is none as in MongoDB.
+func (s *MemoryUserStore) Update(ctx context.Context, user users.User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[user.ID]; !ok {
+		return nil
+	}
+	return s.save(user)
+}
+
+// save stores the user, keeping the email addresses unique.  The caller holds
+// the mutex.
+func (s *MemoryUserStore) save(user users.User) error {
+	for id, other := range s.users {
+		if id != user.ID && user.EmailAddress != "" &&
+			strings.EqualFold(other.EmailAddress, user.EmailAddress) {
+			return errors.New("email address already in use")
+		}
+	}
+	s.users[user.ID] = CopyUser(user)
+	return nil
+}
+
+func (s *MemoryUserStore) Delete(ctx context.Context, id string) error {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.users, oID)
+	return nil
+}
+
+// MemoryEmployeeStore keeps the employees in memory.
+type MemoryEmployeeStore struct {
+	mutex sync.Mutex
+	emps  map[primitive.ObjectID]employees.Employee
+}
+
+func (s *MemoryEmployeeStore) find(match func(employees.Employee) bool) (*employees.Employee, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, emp := range s.emps {
+		if match(emp) {
+			return &emp, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *MemoryEmployeeStore) GetByID(ctx context.Context,
+	id primitive.ObjectID) (*employees.Employee, error) {
+	return s.find(func(emp employees.Employee) bool { return emp.ID == id })
+}
+
+func (s *MemoryEmployeeStore) GetByName(ctx context.Context, first, middle,
+	last string) (*employees.Employee, error) {
+	return s.find(func(emp employees.Employee) bool {
+		return emp.Name.FirstName == first && emp.Name.MiddleName == middle &&
+			emp.Name.LastName == last
+	})
+}
+
+func (s *MemoryEmployeeStore) GetInTeam(ctx context.Context,
+	teamID primitive.ObjectID, first, middle,
+	last string) (*employees.Employee, error) {
+	return s.find(func(emp employees.Employee) bool {
+		return emp.TeamID == teamID && emp.Name.FirstName == first &&
+			(middle == "" || emp.Name.MiddleName == middle) &&
+			emp.Name.LastName == last
+	})
+}
+
+func (s *MemoryEmployeeStore) GetAll(ctx context.Context, teamID primitive.ObjectID,
+	siteID string) ([]employees.Employee, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var emps []employees.Employee
+	for _, emp := range s.emps {
+		if emp.TeamID == teamID && (siteID == "" || emp.SiteID == siteID) {
+			emps = append(emps, emp)
+		}
+	}
+	sort.Slice(emps, func(i, j int) bool { return emps[i].ID.Hex() < emps[j].ID.Hex() })
+	return emps, nil
+}
+
+func (s *MemoryEmployeeStore) Insert(ctx context.Context, emp employees.Employee) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.emps[emp.ID]; ok {
+		return errors.New("duplicate employee id")
+	}
+	emp.User = nil
+	s.emps[emp.ID] = emp
+	return nil
+}
+
+func (s *MemoryEmployeeStore) Update(ctx context.Context, emp employees.Employee) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.emps[emp.ID]; ok {
+		emp.User = nil
+		s.emps[emp.ID] = emp
+	}
+	return nil
+}
+
+func (s *MemoryEmployeeStore) Delete(ctx context.Context,
+	id primitive.ObjectID) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.emps[id]
+	delete(s.emps, id)
+	return ok, nil
+}
+
+// MemoryAuditStore keeps the audit trail in memory, in the order written.
+type MemoryAuditStore struct {
+	mutex       sync.Mutex
+	events      []AuditEvent
+	checkpoints []AuditCheckpoint
+}
+
+func (s *MemoryAuditStore) Last(ctx context.Context) (*AuditEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var last *AuditEvent
+	for i, evt := range s.events {
+		if evt.Seq > 0 && (last == nil || evt.Seq > last.Seq) {
+			last = &s.events[i]
+		}
+	}
+	if last == nil {
+		return nil, nil
+	}
+	found := *last
+	return &found, nil
+}
+
+func (s *MemoryAuditStore) Insert(ctx context.Context, evt AuditEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, other := range s.events {
+		if evt.Seq > 0 && other.Seq == evt.Seq {
+			return ErrAuditSeqTaken
+		}
+	}
+	if evt.ID.IsZero() {
+		evt.ID = primitive.NewObjectID()
+	}
+	s.events = append(s.events, evt)
+	return nil
+}
+
+func (s *MemoryAuditStore) matching(filter AuditFilter) []AuditEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events []AuditEvent
+	for _, evt := range s.events {
+		if filter.matches(evt) {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+func (s *MemoryAuditStore) Find(ctx context.Context, filter AuditFilter, skip,
+	limit int64) ([]AuditEvent, error) {
+	events := s.matching(filter)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if skip >= int64(len(events)) {
+		return []AuditEvent{}, nil
+	}
+	events = events[skip:]
+	if limit > 0 && limit < int64(len(events)) {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (s *MemoryAuditStore) Count(ctx context.Context, filter AuditFilter) (int64, error) {
+	return int64(len(s.matching(filter))), nil
+}
+
+func (s *MemoryAuditStore) Walk(ctx context.Context, fn func(AuditEvent) error) error {
+	s.mutex.Lock()
+	var chain []AuditEvent
+	for _, evt := range s.events {
+		if evt.Seq > 0 {
+			chain = append(chain, evt)
+		}
+	}
+	s.mutex.Unlock()
+	sort.Slice(chain, func(i, j int) bool { return chain[i].Seq < chain[j].Seq })
+	for _, evt := range chain {
+		if err := fn(evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryAuditStore) LastCheckpoint(ctx context.Context) (*AuditCheckpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var last *AuditCheckpoint
+	for i, cp := range s.checkpoints {
+		if last == nil || cp.Seq > last.Seq {
+			last = &s.checkpoints[i]
+		}
+	}
+	if last == nil {
+		return nil, nil
+	}
+	found := *last
+	return &found, nil
+}
+
+func (s *MemoryAuditStore) InsertCheckpoint(ctx context.Context,
+	cp AuditCheckpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkpoints = append(s.checkpoints, cp)
+	return nil
+}
+
+func (s *MemoryAuditStore) Checkpoints(ctx context.Context) ([]AuditCheckpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]AuditCheckpoint{}, s.checkpoints...), nil
+}
+
+// Archives provides no archives, as the audit trail is only archived to files
+// from MongoDB.
+func (s *MemoryAuditStore) Archives(ctx context.Context) ([]AuditArchive, error) {
+	return []AuditArchive{}, nil
+}
+
+// matches reports whether the event is selected by the filter, as query does
+// for MongoDB.
+func (f AuditFilter) matches(evt AuditEvent) bool {
+	switch {
+	case f.UserID != "" && evt.ActorID != f.UserID && evt.TargetID != f.UserID:
+		return false
+	case f.ActorID != "" && evt.ActorID != f.ActorID:
+		return false
+	case f.TargetID != "" && evt.TargetID != f.TargetID:
+		return false
+	case f.Action != "" && evt.Action != f.Action:
+		return false
+	case f.Category != "" && evt.Category != NormalizeCategory(f.Category):
+		return false
+	case f.Application != "" && evt.Application != f.Application:
+		return false
+	case f.Outcome != "" && evt.Outcome != strings.ToLower(f.Outcome):
+		return false
+	case f.From != nil && evt.Time.Before(*f.From):
+		return false
+	case f.To != nil && !evt.Time.Before(*f.To):
+		return false
+	}
+	return true
+}
+
+// MemorySessionStore signs tokens with the shared go-models functions, which
+// need no database, and keeps the known devices in memory.
+type MemorySessionStore struct {
+	mutex   sync.Mutex
+	devices map[string]KnownDevice
+}
+
+func (s *MemorySessionStore) CreateToken(id primitive.ObjectID, email string) (string, error) {
+	return svcs.CreateToken(id, email)
+}
+
+func (s *MemorySessionStore) ValidateToken(token string) (*svcs.JWTClaim, error) {
+	return svcs.ValidateToken(token)
+}
+
+func (s *MemorySessionStore) TouchDevice(ctx context.Context,
+	userID primitive.ObjectID, ip, userAgent string,
+	now time.Time) (bool, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := userID.Hex() + "|" + ip + "|" + userAgent
+	if device, ok := s.devices[key]; ok {
+		device.LastSeen = now
+		s.devices[key] = device
+		return false, true, nil
+	}
+
+	hadOthers := false
+	for _, device := range s.devices {
+		if device.UserID == userID {
+			hadOthers = true
+		}
+	}
+	s.devices[key] = KnownDevice{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		IPAddress: ip,
+		UserAgent: userAgent,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	return true, hadOthers, nil
+}
+
+// MemoryAccountStore keeps the account statuses, deactivation marks,
+// password change tokens and expiry notices in memory.
+type MemoryAccountStore struct {
+	mutex    sync.Mutex
+	statuses map[primitive.ObjectID]AccountStatus
+	deleted  map[primitive.ObjectID]DeletedUser
+	changes  map[primitive.ObjectID]PasswordChangeToken
+	notices  map[primitive.ObjectID]ExpiryNotice
+}
+
+func (s *MemoryAccountStore) GetStatus(ctx context.Context,
+	id primitive.ObjectID) (*AccountStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status, ok := s.statuses[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &status, nil
+}
+
+func (s *MemoryAccountStore) SaveStatus(ctx context.Context, status AccountStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statuses[status.ID] = status
+	return nil
+}
+
+func (s *MemoryAccountStore) DeleteStatus(ctx context.Context,
+	id primitive.ObjectID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.statuses, id)
+	return nil
+}
+
+func (s *MemoryAccountStore) ExpireStatuses(ctx context.Context,
+	now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for id, status := range s.statuses {
+		if status.Status == StatusActive && status.EndDate != nil &&
+			status.EndDate.Before(now) {
+			status.Status = StatusExpired
+			status.Reason = "end date passed"
+			status.UpdatedBy = "system"
+			status.Updated = now
+			s.statuses[id] = status
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryAccountStore) MarkDeleted(ctx context.Context, mark DeletedUser) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.deleted[mark.ID]; !ok {
+		s.deleted[mark.ID] = mark
+	}
+	return nil
+}
+
+func (s *MemoryAccountStore) GetDeleted(ctx context.Context,
+	id primitive.ObjectID) (*DeletedUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	deleted, ok := s.deleted[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &deleted, nil
+}
+
+func (s *MemoryAccountStore) GetAllDeleted(ctx context.Context) ([]DeletedUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	all := []DeletedUser{}
+	for _, deleted := range s.deleted {
+		all = append(all, deleted)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID.Hex() < all[j].ID.Hex() })
+	return all, nil
+}
+
+func (s *MemoryAccountStore) Restore(ctx context.Context,
+	id primitive.ObjectID) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.deleted[id]
+	delete(s.deleted, id)
+	return ok, nil
+}
+
+func (s *MemoryAccountStore) SavePasswordChange(ctx context.Context,
+	change PasswordChangeToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, other := range s.changes {
+		if other.UserID == change.UserID {
+			delete(s.changes, id)
+		}
+	}
+	s.changes[change.ID] = change
+	return nil
+}
+
+func (s *MemoryAccountStore) GetPasswordChange(ctx context.Context,
+	tokenHash string) (*PasswordChangeToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, change := range s.changes {
+		if change.TokenHash == tokenHash {
+			return &change, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *MemoryAccountStore) DeletePasswordChange(ctx context.Context,
+	id primitive.ObjectID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.changes, id)
+	return nil
+}
+
+func (s *MemoryAccountStore) GetExpiryNotice(ctx context.Context,
+	id primitive.ObjectID) (*ExpiryNotice, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	notice, ok := s.notices[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	notice.Sent = append([]int(nil), notice.Sent...)
+	return &notice, nil
+}
+
+func (s *MemoryAccountStore) SaveExpiryNotice(ctx context.Context,
+	notice ExpiryNotice) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	notice.Sent = append([]int(nil), notice.Sent...)
+	s.notices[notice.ID] = notice
+	return nil
+}
+
+// MemoryInvitationStore keeps the invitations in memory.
+type MemoryInvitationStore struct {
+	mutex   sync.Mutex
+	invites map[primitive.ObjectID]Invitation
+}
+
+func (s *MemoryInvitationStore) Get(ctx context.Context,
+	id primitive.ObjectID) (*Invitation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	invite, ok := s.invites[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &invite, nil
+}
+
+func (s *MemoryInvitationStore) Save(ctx context.Context, invite Invitation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.invites[invite.ID] = invite
+	return nil
+}
+
+func (s *MemoryInvitationStore) Delete(ctx context.Context,
+	id primitive.ObjectID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.invites, id)
+	return nil
+}
+
+// MemoryEmailChangeStore keeps the pending email changes and revert links in
+// memory.
+type MemoryEmailChangeStore struct {
+	mutex   sync.Mutex
+	changes map[primitive.ObjectID]EmailChange
+	reverts []EmailRevert
+}
+
+func (s *MemoryEmailChangeStore) Get(ctx context.Context,
+	id primitive.ObjectID) (*EmailChange, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change, ok := s.changes[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &change, nil
+}
+
+func (s *MemoryEmailChangeStore) Save(ctx context.Context, change EmailChange) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changes[change.ID] = change
+	return nil
+}
+
+func (s *MemoryEmailChangeStore) Delete(ctx context.Context,
+	id primitive.ObjectID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.changes, id)
+	return nil
+}
+
+func (s *MemoryEmailChangeStore) IsPending(ctx context.Context, email string,
+	exceptID primitive.ObjectID, now time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	email = strings.TrimSpace(email)
+	for id, change := range s.changes {
+		if id != exceptID && strings.EqualFold(change.NewEmail, email) &&
+			change.Expires.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryEmailChangeStore) InsertRevert(ctx context.Context,
+	revert EmailRevert) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reverts = append(s.reverts, revert)
+	return nil
+}
+
+func (s *MemoryEmailChangeStore) GetRevert(ctx context.Context,
+	tokenHash string) (*EmailRevert, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, revert := range s.reverts {
+		if revert.TokenHash == tokenHash {
+			return &revert, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *MemoryEmailChangeStore) MarkReverted(ctx context.Context,
+	id primitive.ObjectID, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.reverts {
+		if s.reverts[i].ID == id {
+			s.reverts[i].Reverted = &now
+			return nil
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+// MemoryNotificationStore keeps the contact preferences and alert settings in
+// memory.
+type MemoryNotificationStore struct {
+	mutex    sync.Mutex
+	contacts map[primitive.ObjectID]ContactPreference
+	alerts   map[string]AlertSetting
+}
+
+func (s *MemoryNotificationStore) GetContact(ctx context.Context,
+	id primitive.ObjectID) (*ContactPreference, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pref, ok := s.contacts[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &pref, nil
+}
+
+func (s *MemoryNotificationStore) SaveContact(ctx context.Context,
+	pref ContactPreference) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.contacts[pref.ID] = pref
+	return nil
+}
+
+func (s *MemoryNotificationStore) GetAlertSettings(ctx context.Context) ([]AlertSetting,
+	error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	settings := []AlertSetting{}
+	for _, setting := range s.alerts {
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+func (s *MemoryNotificationStore) SaveAlertSetting(ctx context.Context,
+	setting AlertSetting) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.alerts[setting.Event] = setting
+	return nil
+}
+
+// MemoryOutboxStore keeps the queued messages in memory, in the order queued.
+type MemoryOutboxStore struct {
+	mutex sync.Mutex
+	msgs  []OutboxMessage
+}
+
+func (s *MemoryOutboxStore) Insert(ctx context.Context, msg OutboxMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, other := range s.msgs {
+		if other.ID == msg.ID {
+			return errors.New("duplicate message id")
+		}
+	}
+	msg.Message = EmailMessage{}
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func (s *MemoryOutboxStore) GetByID(ctx context.Context,
+	id primitive.ObjectID) (*OutboxMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, msg := range s.msgs {
+		if msg.ID == id {
+			return &msg, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *MemoryOutboxStore) Claim(ctx context.Context, now,
+	lockedUntil time.Time) (*OutboxMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	due := -1
+	for i, msg := range s.msgs {
+		pending := msg.Status == OutboxPending && !msg.NextAttempt.After(now)
+		stale := msg.Status == OutboxSending && msg.LockedUntil != nil &&
+			msg.LockedUntil.Before(now)
+		if (pending || stale) &&
+			(due < 0 || msg.NextAttempt.Before(s.msgs[due].NextAttempt)) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	s.msgs[due].Status = OutboxSending
+	s.msgs[due].LockedUntil = &lockedUntil
+	msg := s.msgs[due]
+	return &msg, nil
+}
+
+// Update replaces the message, doing nothing when there is none as in
+// MongoDB.
+func (s *MemoryOutboxStore) Update(ctx context.Context, msg OutboxMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, other := range s.msgs {
+		if other.ID == msg.ID {
+			msg.Message = EmailMessage{}
+			s.msgs[i] = msg
+		}
+	}
+	return nil
+}
+
+func (s *MemoryOutboxStore) Find(ctx context.Context, status string,
+	limit int64) ([]OutboxMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	msgs := []OutboxMessage{}
+	for _, msg := range s.msgs {
+		if status == "" || msg.Status == status {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Created.After(msgs[j].Created)
+	})
+	if limit > 0 && limit < int64(len(msgs)) {
+		msgs = msgs[:limit]
+	}
+	return msgs, nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Login outcomes counted by LoginCount.
+const (
+	LoginSuccess         = "success"
+	LoginBadPassword     = "bad_password"
+	LoginUnknownUser     = "unknown_user"
+	LoginDenied          = "denied"
+	LoginPasswordExpired = "password_expired"
+	LoginError           = "error"
+)
+
+var (
+	LoginCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logins_total",
+		Help: "Login attempts by outcome and application.",
+	}, []string{"outcome", "application"})
+
+	TokenRenewalCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_token_renewals_total",
+		Help: "Token renewals by outcome.",
+	}, []string{"outcome"})
+
+	LogoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logouts_total",
+		Help: "Logouts by application.",
+	}, []string{"application"})
+
+	ResetRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_password_reset_requests_total",
+		Help: "Password reset requests by outcome.",
+	}, []string{"outcome"})
+
+	LockoutCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_lockouts_total",
+		Help: "Accounts locked by failed logins.",
+	})
+
+	EmailFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_email_send_failures_total",
+		Help: "Failed email deliveries, by whether the message was dead-lettered.",
+	}, []string{"final"})
+
+	IndexReady = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "auth_index_ready",
+		Help: "Whether the index group was created, 1, or couldn't be, 0.",
+	}, []string{"index"})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_mongo_operation_duration_seconds",
+		Help:    "MongoDB command latency by collection, command and outcome.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"collection", "command", "outcome"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+// MetricApplication limits the application label to the known applications.
+func MetricApplication(application string) string {
+	application = strings.ToLower(application)
+	if _, ok := emailBrands[application]; ok {
+		return application
+	}
+	return "other"
+}
+
+// HTTPMetrics is middleware recording the latency of each request by its
+// route pattern, so path parameters don't create new series.
+func HTTPMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(route, c.Request.Method,
+			strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler serves the metrics.  When a token is given, scrapers must
+// send it as a bearer token.
+func MetricsHandler(token string) gin.HandlerFunc {
+	handler := promhttp.Handler()
+	return func(c *gin.Context) {
+		if token != "" {
+			auth := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// mongoMetricsMonitor times each MongoDB command.  The collection is taken
+// from the command when it starts, since the finished event doesn't name it.
+func mongoMetricsMonitor() *event.CommandMonitor {
+	var started sync.Map
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) {
+			started.Store(evt.RequestID, commandCollection(evt.CommandName, evt.Command))
+		},
+		Succeeded: func(_ context.Context, evt *event.CommandSucceededEvent) {
+			if col, ok := started.LoadAndDelete(evt.RequestID); ok {
+				mongoDuration.WithLabelValues(col.(string), evt.CommandName, "success").
+					Observe(evt.Duration.Seconds())
+			}
+		},
+		Failed: func(_ context.Context, evt *event.CommandFailedEvent) {
+			if col, ok := started.LoadAndDelete(evt.RequestID); ok {
+				mongoDuration.WithLabelValues(col.(string), evt.CommandName, "failure").
+					Observe(evt.Duration.Seconds())
+			}
+		},
+	}
+}
+
+func commandCollection(name string, command bson.Raw) string {
+	if value, err := command.LookupErr(name); err == nil {
+		if col, ok := value.StringValueOK(); ok {
+			return col
+		}
+	}
+	if value, err := command.LookupErr("collection"); err == nil {
+		if col, ok := value.StringValueOK(); ok {
+			return col
+		}
+	}
+	return "none"
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoDatabase is returned for the records only kept in MongoDB when the
+// service runs on the in-memory stores without it.
+var ErrNoDatabase = errors.New("no database connected")
+
+// ConnectMongo connects to the database given by the mongo.uri setting
+// (MONGO_URI) with the service's command metrics and tracing, and makes it the
+// client used by config.GetCollection.
+func ConnectMongo() *mongo.Client {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Client().
+		ApplyURI(GetSettings().Mongo.URI).
+		SetMonitor(combineMonitors(mongoMetricsMonitor(), mongoTracingMonitor()))
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		Logger.Error("ConnectMongo problem", "error", err)
+		return nil
+	}
+	// the driver reconnects on its own, so an unreachable server is reported
+	// by the readiness check rather than stopping the service.
+	if err := client.Ping(ctx, nil); err != nil {
+		Logger.Error("ConnectMongo: ping problem", "error", err)
+	}
+	config.DB = client
+	return client
+}
@@ -0,0 +1,706 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/employees"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoStores provides the stores kept in MongoDB, through config.DB.
+func NewMongoStores() *Stores {
+	return &Stores{
+		Users:         &MongoUserStore{},
+		Employees:     &MongoEmployeeStore{},
+		Audit:         &MongoAuditStore{},
+		Sessions:      &MongoSessionStore{},
+		Accounts:      &MongoAccountStore{},
+		Invitations:   &MongoInvitationStore{},
+		EmailChanges:  &MongoEmailChangeStore{},
+		Notifications: &MongoNotificationStore{},
+		Outbox:        &MongoOutboxStore{},
+	}
+}
+
+// MongoUserStore keeps the users in the authenticate database.  New users are
+// created with the shared go-models function, which hashes the password.
+type MongoUserStore struct{}
+
+func getUserCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "users")
+}
+
+func (s *MongoUserStore) GetByID(ctx context.Context, id string) (*users.User, error) {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	var user users.User
+	err = getUserCollection().FindOne(ctx, bson.M{"_id": oID}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoUserStore) GetByEmail(ctx context.Context,
+	email string) (*users.User, error) {
+	filter := bson.M{
+		"emailAddress": strings.TrimSpace(email),
+	}
+	var user users.User
+	err := getUserCollection().FindOne(ctx, filter,
+		options.FindOne().SetCollation(emailCollation)).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoUserStore) GetByName(ctx context.Context, first,
+	last string) (*users.User, error) {
+	filter := bson.M{
+		"firstName": first,
+		"lastName":  last,
+	}
+	var user users.User
+	if err := getUserCollection().FindOne(ctx, filter).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoUserStore) GetAll(ctx context.Context) ([]users.User, error) {
+	var usrs []users.User
+	cursor, err := getUserCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &usrs); err != nil {
+		return nil, err
+	}
+	return usrs, nil
+}
+
+func (s *MongoUserStore) Create(ctx context.Context, email, first, middle, last,
+	passwd string) (*users.User, error) {
+	user := svcs.CreateUser(email, first, middle, last, passwd)
+	if user == nil {
+		return nil, errors.New("user not created")
+	}
+	return user, nil
+}
+
+func (s *MongoUserStore) Insert(ctx context.Context, user users.User) error {
+	_, err := getUserCollection().InsertOne(ctx, user)
+	return err
+}
+
+func (s *MongoUserStore) Update(ctx context.Context, user users.User) error {
+	_, err := getUserCollection().ReplaceOne(ctx, bson.M{"_id": user.ID}, user)
+	return err
+}
+
+func (s *MongoUserStore) Delete(ctx context.Context, id string) error {
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	_, err = getUserCollection().DeleteOne(ctx, bson.M{"_id": oID})
+	return err
+}
+
+// MongoEmployeeStore keeps the employees in the scheduler database.
+type MongoEmployeeStore struct{}
+
+func getEmployeeCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "scheduler", "employees")
+}
+
+func (s *MongoEmployeeStore) findOne(ctx context.Context,
+	filter bson.M) (*employees.Employee, error) {
+	var emp employees.Employee
+	if err := getEmployeeCollection().FindOne(ctx, filter).Decode(&emp); err != nil {
+		return nil, err
+	}
+	return &emp, nil
+}
+
+func (s *MongoEmployeeStore) GetByID(ctx context.Context,
+	id primitive.ObjectID) (*employees.Employee, error) {
+	return s.findOne(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoEmployeeStore) GetByName(ctx context.Context, first, middle,
+	last string) (*employees.Employee, error) {
+	return s.findOne(ctx, bson.M{
+		"name.firstname":  first,
+		"name.middlename": middle,
+		"name.lastname":   last,
+	})
+}
+
+func (s *MongoEmployeeStore) GetInTeam(ctx context.Context,
+	teamID primitive.ObjectID, first, middle,
+	last string) (*employees.Employee, error) {
+	filter := bson.M{
+		"name.firstName": first,
+		"name.lastName":  last,
+		"team":           teamID,
+	}
+	if middle != "" {
+		filter["name.middleName"] = middle
+	}
+	return s.findOne(ctx, filter)
+}
+
+func (s *MongoEmployeeStore) GetAll(ctx context.Context, teamID primitive.ObjectID,
+	siteID string) ([]employees.Employee, error) {
+	filter := bson.M{
+		"team": teamID,
+	}
+	if siteID != "" {
+		filter["site"] = siteID
+	}
+
+	var emps []employees.Employee
+	cursor, err := getEmployeeCollection().Find(ctx, filter)
+	if err != nil {
+		return emps[:0], err
+	}
+	if err = cursor.All(ctx, &emps); err != nil {
+		Logger.Error("GetEmployees: decode problem", "error", err)
+	}
+	return emps, nil
+}
+
+func (s *MongoEmployeeStore) Insert(ctx context.Context, emp employees.Employee) error {
+	_, err := getEmployeeCollection().InsertOne(ctx, emp)
+	return err
+}
+
+func (s *MongoEmployeeStore) Update(ctx context.Context, emp employees.Employee) error {
+	_, err := getEmployeeCollection().ReplaceOne(ctx,
+		bson.M{"_id": emp.ID}, emp)
+	return err
+}
+
+func (s *MongoEmployeeStore) Delete(ctx context.Context,
+	id primitive.ObjectID) (bool, error) {
+	result, err := getEmployeeCollection().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// MongoAuditStore keeps the audit trail in the audit collection, whose unique
+// sequence index stops two writers extending the chain from the same event.
+type MongoAuditStore struct{}
+
+func (s *MongoAuditStore) Last(ctx context.Context) (*AuditEvent, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})
+	var evt AuditEvent
+	err := getAuditCollection().FindOne(ctx,
+		bson.M{"seq": bson.M{"$exists": true}}, opts).Decode(&evt)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func (s *MongoAuditStore) Insert(ctx context.Context, evt AuditEvent) error {
+	_, err := getAuditCollection().InsertOne(ctx, evt)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAuditSeqTaken
+	}
+	return err
+}
+
+func (s *MongoAuditStore) Find(ctx context.Context, filter AuditFilter, skip,
+	limit int64) ([]AuditEvent, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(limit)
+
+	events := []AuditEvent{}
+	cursor, err := getAuditCollection().Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *MongoAuditStore) Count(ctx context.Context, filter AuditFilter) (int64, error) {
+	return getAuditCollection().CountDocuments(ctx, filter.query())
+}
+
+func (s *MongoAuditStore) Walk(ctx context.Context, fn func(AuditEvent) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}})
+	cursor, err := getAuditCollection().Find(ctx,
+		bson.M{"seq": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var evt AuditEvent
+		if err := cursor.Decode(&evt); err != nil {
+			return err
+		}
+		if err := fn(evt); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoAuditStore) LastCheckpoint(ctx context.Context) (*AuditCheckpoint, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})
+	var cp AuditCheckpoint
+	err := getAuditCheckpointCollection().FindOne(ctx, bson.M{}, opts).Decode(&cp)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func (s *MongoAuditStore) InsertCheckpoint(ctx context.Context,
+	cp AuditCheckpoint) error {
+	_, err := getAuditCheckpointCollection().InsertOne(ctx, cp)
+	return err
+}
+
+func (s *MongoAuditStore) Checkpoints(ctx context.Context) ([]AuditCheckpoint, error) {
+	var checkpoints []AuditCheckpoint
+	cursor, err := getAuditCheckpointCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+func (s *MongoAuditStore) Archives(ctx context.Context) ([]AuditArchive, error) {
+	var archives []AuditArchive
+	cursor, err := getAuditArchiveCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &archives); err != nil {
+		return nil, err
+	}
+	return archives, nil
+}
+
+// MongoSessionStore signs tokens with the shared go-models functions and
+// keeps the known devices in the devices collection.
+type MongoSessionStore struct{}
+
+func getKnownDeviceCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "devices")
+}
+
+func (s *MongoSessionStore) CreateToken(id primitive.ObjectID, email string) (string, error) {
+	return svcs.CreateToken(id, email)
+}
+
+func (s *MongoSessionStore) ValidateToken(token string) (*svcs.JWTClaim, error) {
+	return svcs.ValidateToken(token)
+}
+
+func (s *MongoSessionStore) TouchDevice(ctx context.Context,
+	userID primitive.ObjectID, ip, userAgent string,
+	now time.Time) (bool, bool, error) {
+	filter := bson.M{
+		"userid":    userID,
+		"ipAddress": ip,
+		"userAgent": userAgent,
+	}
+	update := bson.M{
+		"$set": bson.M{"lastSeen": now},
+	}
+	result, err := getKnownDeviceCollection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, false, err
+	}
+	if result.MatchedCount > 0 {
+		return false, true, nil
+	}
+
+	count, err := getKnownDeviceCollection().CountDocuments(ctx,
+		bson.M{"userid": userID})
+	if err != nil {
+		return false, false, err
+	}
+	device := KnownDevice{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		IPAddress: ip,
+		UserAgent: userAgent,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	if _, err := getKnownDeviceCollection().InsertOne(ctx, device); err != nil {
+		return false, false, err
+	}
+	return true, count > 0, nil
+}
+
+// MongoAccountStore keeps the account statuses, deactivation marks, password
+// change tokens and expiry notices in their collections of the authenticate
+// database.
+type MongoAccountStore struct{}
+
+func (s *MongoAccountStore) GetStatus(ctx context.Context,
+	id primitive.ObjectID) (*AccountStatus, error) {
+	var status AccountStatus
+	err := getAccountStatusCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (s *MongoAccountStore) SaveStatus(ctx context.Context, status AccountStatus) error {
+	_, err := getAccountStatusCollection().ReplaceOne(ctx, bson.M{"_id": status.ID},
+		status, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoAccountStore) DeleteStatus(ctx context.Context,
+	id primitive.ObjectID) error {
+	_, err := getAccountStatusCollection().DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *MongoAccountStore) ExpireStatuses(ctx context.Context,
+	now time.Time) (int, error) {
+	filter := bson.M{
+		"status":  StatusActive,
+		"endDate": bson.M{"$lt": now},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":    StatusExpired,
+			"reason":    "end date passed",
+			"updatedBy": "system",
+			"updated":   now,
+		},
+	}
+	result, err := getAccountStatusCollection().UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+func (s *MongoAccountStore) MarkDeleted(ctx context.Context, mark DeletedUser) error {
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"emailAddress": mark.EmailAddress,
+			"name":         mark.Name,
+			"deletedOn":    mark.DeletedOn,
+			"deletedBy":    mark.DeletedBy,
+		},
+	}
+	_, err := getDeletedUserCollection().UpdateOne(ctx, bson.M{"_id": mark.ID}, update,
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoAccountStore) GetDeleted(ctx context.Context,
+	id primitive.ObjectID) (*DeletedUser, error) {
+	var deleted DeletedUser
+	err := getDeletedUserCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&deleted)
+	if err != nil {
+		return nil, err
+	}
+	return &deleted, nil
+}
+
+func (s *MongoAccountStore) GetAllDeleted(ctx context.Context) ([]DeletedUser, error) {
+	var deleted []DeletedUser
+	cursor, err := getDeletedUserCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &deleted); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (s *MongoAccountStore) Restore(ctx context.Context,
+	id primitive.ObjectID) (bool, error) {
+	result, err := getDeletedUserCollection().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoAccountStore) SavePasswordChange(ctx context.Context,
+	change PasswordChangeToken) error {
+	_, err := getPasswordChangeCollection().DeleteMany(ctx,
+		bson.M{"userid": change.UserID})
+	if err != nil {
+		return err
+	}
+	_, err = getPasswordChangeCollection().InsertOne(ctx, change)
+	return err
+}
+
+func (s *MongoAccountStore) GetPasswordChange(ctx context.Context,
+	tokenHash string) (*PasswordChangeToken, error) {
+	var change PasswordChangeToken
+	err := getPasswordChangeCollection().FindOne(ctx,
+		bson.M{"tokenHash": tokenHash}).Decode(&change)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (s *MongoAccountStore) DeletePasswordChange(ctx context.Context,
+	id primitive.ObjectID) error {
+	_, err := getPasswordChangeCollection().DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *MongoAccountStore) GetExpiryNotice(ctx context.Context,
+	id primitive.ObjectID) (*ExpiryNotice, error) {
+	var notice ExpiryNotice
+	err := getExpiryNoticeCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&notice)
+	if err != nil {
+		return nil, err
+	}
+	return &notice, nil
+}
+
+func (s *MongoAccountStore) SaveExpiryNotice(ctx context.Context,
+	notice ExpiryNotice) error {
+	_, err := getExpiryNoticeCollection().ReplaceOne(ctx, bson.M{"_id": notice.ID},
+		notice, options.Replace().SetUpsert(true))
+	return err
+}
+
+// MongoInvitationStore keeps the invitations in the invitations collection.
+type MongoInvitationStore struct{}
+
+func (s *MongoInvitationStore) Get(ctx context.Context,
+	id primitive.ObjectID) (*Invitation, error) {
+	var invite Invitation
+	err := getInvitationCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&invite)
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (s *MongoInvitationStore) Save(ctx context.Context, invite Invitation) error {
+	_, err := getInvitationCollection().ReplaceOne(ctx, bson.M{"_id": invite.ID},
+		invite, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoInvitationStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := getInvitationCollection().DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// MongoEmailChangeStore keeps the pending email changes and revert links in
+// the emailchanges and emailreverts collections.
+type MongoEmailChangeStore struct{}
+
+func (s *MongoEmailChangeStore) Get(ctx context.Context,
+	id primitive.ObjectID) (*EmailChange, error) {
+	var change EmailChange
+	err := getEmailChangeCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&change)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (s *MongoEmailChangeStore) Save(ctx context.Context, change EmailChange) error {
+	_, err := getEmailChangeCollection().ReplaceOne(ctx, bson.M{"_id": change.ID},
+		change, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoEmailChangeStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := getEmailChangeCollection().DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *MongoEmailChangeStore) IsPending(ctx context.Context, email string,
+	exceptID primitive.ObjectID, now time.Time) (bool, error) {
+	filter := bson.M{
+		"newEmail": strings.TrimSpace(email),
+		"_id":      bson.M{"$ne": exceptID},
+		"expires":  bson.M{"$gt": now},
+	}
+	count, err := getEmailChangeCollection().CountDocuments(ctx, filter,
+		options.Count().SetCollation(emailCollation))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *MongoEmailChangeStore) InsertRevert(ctx context.Context,
+	revert EmailRevert) error {
+	_, err := getEmailRevertCollection().InsertOne(ctx, revert)
+	return err
+}
+
+func (s *MongoEmailChangeStore) GetRevert(ctx context.Context,
+	tokenHash string) (*EmailRevert, error) {
+	var revert EmailRevert
+	err := getEmailRevertCollection().FindOne(ctx,
+		bson.M{"tokenHash": tokenHash}).Decode(&revert)
+	if err != nil {
+		return nil, err
+	}
+	return &revert, nil
+}
+
+func (s *MongoEmailChangeStore) MarkReverted(ctx context.Context,
+	id primitive.ObjectID, now time.Time) error {
+	_, err := getEmailRevertCollection().UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"reverted": now}})
+	return err
+}
+
+// MongoNotificationStore keeps the contact preferences and alert settings in
+// the contacts and alertsettings collections.
+type MongoNotificationStore struct{}
+
+func (s *MongoNotificationStore) GetContact(ctx context.Context,
+	id primitive.ObjectID) (*ContactPreference, error) {
+	var pref ContactPreference
+	err := getContactCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&pref)
+	if err != nil {
+		return nil, err
+	}
+	return &pref, nil
+}
+
+func (s *MongoNotificationStore) SaveContact(ctx context.Context,
+	pref ContactPreference) error {
+	_, err := getContactCollection().ReplaceOne(ctx, bson.M{"_id": pref.ID}, pref,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoNotificationStore) GetAlertSettings(ctx context.Context) ([]AlertSetting,
+	error) {
+	var settings []AlertSetting
+	cursor, err := getAlertSettingCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *MongoNotificationStore) SaveAlertSetting(ctx context.Context,
+	setting AlertSetting) error {
+	_, err := getAlertSettingCollection().ReplaceOne(ctx, bson.M{"_id": setting.Event},
+		setting, options.Replace().SetUpsert(true))
+	return err
+}
+
+// MongoOutboxStore keeps the queued messages in the outbox collection, where
+// claiming a message is atomic so only one instance delivers it.
+type MongoOutboxStore struct{}
+
+func (s *MongoOutboxStore) Insert(ctx context.Context, msg OutboxMessage) error {
+	_, err := getOutboxCollection().InsertOne(ctx, msg)
+	return err
+}
+
+func (s *MongoOutboxStore) GetByID(ctx context.Context,
+	id primitive.ObjectID) (*OutboxMessage, error) {
+	var msg OutboxMessage
+	err := getOutboxCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *MongoOutboxStore) Claim(ctx context.Context, now,
+	lockedUntil time.Time) (*OutboxMessage, error) {
+	filter := bson.M{
+		"$or": []bson.M{
+			{"status": OutboxPending, "nextAttempt": bson.M{"$lte": now}},
+			{"status": OutboxSending, "lockedUntil": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":      OutboxSending,
+			"lockedUntil": lockedUntil,
+		},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttempt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var msg OutboxMessage
+	err := getOutboxCollection().FindOneAndUpdate(ctx, filter, update,
+		opts).Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *MongoOutboxStore) Update(ctx context.Context, msg OutboxMessage) error {
+	_, err := getOutboxCollection().ReplaceOne(ctx, bson.M{"_id": msg.ID}, msg)
+	return err
+}
+
+func (s *MongoOutboxStore) Find(ctx context.Context, status string,
+	limit int64) ([]OutboxMessage, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created", Value: -1}}).
+		SetLimit(limit)
+
+	var msgs []OutboxMessage
+	cursor, err := getOutboxCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
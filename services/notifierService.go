@@ -0,0 +1,458 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	ChannelEmail   = "email"
+	ChannelSMS     = "sms"
+	ChannelWebhook = "webhook"
+)
+
+// Notifier delivers a templated notification to a recipient over one channel.
+// The recipient is an email address, phone number or webhook URL depending on
+// the channel.
+type Notifier interface {
+	Channel() string
+	Notify(ctx context.Context, recipient, template, application string,
+		data map[string]interface{}) error
+}
+
+// EmailNotifier queues the notification in the email outbox.
+type EmailNotifier struct{}
+
+func (n *EmailNotifier) Channel() string {
+	return ChannelEmail
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, recipient, template,
+	application string, data map[string]interface{}) error {
+	return SendTemplateEmail(ctx, []string{recipient}, template, application, data)
+}
+
+// SMSNotifier posts the message to an HTTP SMS gateway as JSON
+// {"to": ..., "message": ...}.  Without a gateway URL nothing can be sent, and
+// the error lets NotifyUser fall back to email.
+type SMSNotifier struct {
+	GatewayURL string
+	Token      string
+	Client     *http.Client
+}
+
+func (n *SMSNotifier) Channel() string {
+	return ChannelSMS
+}
+
+func (n *SMSNotifier) Notify(ctx context.Context, recipient, template,
+	application string, data map[string]interface{}) error {
+	message, err := RenderSMS(ctx, template, application, data)
+	if err != nil {
+		return err
+	}
+	if n.GatewayURL == "" {
+		return errors.New("SMS gateway not configured")
+	}
+	body, err := json.Marshal(map[string]string{
+		"to":      recipient,
+		"message": message,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.GatewayURL,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return doNotifierRequest(n.Client, req)
+}
+
+// WebhookNotifier posts the rendered notification as JSON to the recipient
+// URL.  When a secret is set, the body's HMAC-SHA256 is sent in the
+// X-Signature header.  Only public addresses are connected to, so a webhook
+// can't reach services inside the network.
+type WebhookNotifier struct {
+	Secret string
+	Client *http.Client
+}
+
+type WebhookPayload struct {
+	Template    string                 `json:"template"`
+	Application string                 `json:"application"`
+	Subject     string                 `json:"subject"`
+	Text        string                 `json:"text"`
+	Data        map[string]interface{} `json:"data"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+func (n *WebhookNotifier) Channel() string {
+	return ChannelWebhook
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, recipient, template,
+	application string, data map[string]interface{}) error {
+	msg, err := RenderEmail(ctx, template, application, data)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(WebhookPayload{
+		Template:    template,
+		Application: application,
+		Subject:     msg.Subject,
+		Text:        msg.Text,
+		Data:        data,
+		Timestamp:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, recipient,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := n.Client
+	if client == nil {
+		client = newWebhookClient()
+	}
+	return doNotifierRequest(client, req)
+}
+
+// cgnatBlock is the carrier-grade NAT range, shared address space that isn't
+// reachable from the internet.
+var cgnatBlock = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether the address is reachable on the internet, rather
+// than loopback, private, link-local or otherwise internal.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnatBlock.Contains(ip))
+}
+
+// newWebhookClient provides a client which refuses to connect to internal
+// addresses.  The check is made on the address dialed, so neither a DNS
+// answer changed after the URL was accepted nor a redirect gets around it.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errors.New("webhook address " + host + " is not public")
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// checkWebhookURL checks that the webhook is an http or https URL whose host
+// resolves only to public addresses.
+func checkWebhookURL(ctx context.Context, webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("invalid webhook url")
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return errors.New("webhook host can't be resolved")
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return errors.New("webhook url must be a public address")
+		}
+	}
+	return nil
+}
+
+func doNotifierRequest(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// RenderSMS provides the short text of a notification from the template's
+// .sms file, or the email subject when the template has none.
+func RenderSMS(ctx context.Context, name, application string,
+	data map[string]interface{}) (string, error) {
+	source, err := loadTemplateSource(ctx, name, application, "sms")
+	if err != nil {
+		msg, err := RenderEmail(ctx, name, application, data)
+		if err != nil {
+			return "", err
+		}
+		return msg.Subject, nil
+	}
+	values := make(map[string]interface{})
+	for k, v := range data {
+		values[k] = v
+	}
+	values["Brand"] = GetEmailBrand(application)
+
+	tmpl, err := texttemplate.New(name).Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// GetNotifier provides the notifier for the channel, configured from
+// SMS_GATEWAY_URL, SMS_GATEWAY_TOKEN and WEBHOOK_SECRET.
+func GetNotifier(channel string) Notifier {
+	switch channel {
+	case ChannelSMS:
+		return &SMSNotifier{
+			GatewayURL: GetSettings().Notify.SMSGatewayURL,
+			Token:      GetSettings().Notify.SMSGatewayToken,
+		}
+	case ChannelWebhook:
+		return &WebhookNotifier{
+			Secret: GetSettings().Notify.WebhookSecret,
+		}
+	}
+	return &EmailNotifier{}
+}
+
+// ContactPreference is how the user wants to receive reset codes and other
+// notifications.  A user without one is notified by email.
+type ContactPreference struct {
+	ID               primitive.ObjectID `json:"id" bson:"_id"`
+	Channel          string             `json:"channel" bson:"channel"`
+	Phone            string             `json:"phone,omitempty" bson:"phone,omitempty"`
+	PhoneVerified    bool               `json:"phoneVerified" bson:"phoneVerified"`
+	PhoneCodeHash    string             `json:"-" bson:"phoneCodeHash,omitempty"`
+	PhoneCodeExpires *time.Time         `json:"-" bson:"phoneCodeExpires,omitempty"`
+	PhoneCodeTries   int                `json:"-" bson:"phoneCodeTries,omitempty"`
+	PendingPhone     string             `json:"pendingPhone,omitempty" bson:"pendingPhone,omitempty"`
+	Webhook          string             `json:"webhook,omitempty" bson:"webhook,omitempty"`
+}
+
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// maxPhoneCodeTries is the number of wrong codes after which the phone
+// verification has to be started again, so the code can't be guessed.
+const maxPhoneCodeTries = 5
+
+func getContactCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "contacts")
+}
+
+func GetContactPreference(ctx context.Context,
+	id primitive.ObjectID) (*ContactPreference, error) {
+	pref, err := GetStores().Notifications.GetContact(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return &ContactPreference{ID: id, Channel: ChannelEmail}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return pref, nil
+}
+
+func saveContactPreference(ctx context.Context, pref ContactPreference) error {
+	return GetStores().Notifications.SaveContact(ctx, pref)
+}
+
+// SetContactPreference changes the user's notification channel.  SMS requires
+// a verified phone number and webhook requires a URL.
+func SetContactPreference(ctx context.Context, id primitive.ObjectID, channel,
+	webhook string) (*ContactPreference, error) {
+	pref, err := GetContactPreference(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if webhook != "" {
+		if err := checkWebhookURL(ctx, webhook); err != nil {
+			return nil, err
+		}
+		pref.Webhook = webhook
+	}
+
+	switch strings.ToLower(channel) {
+	case ChannelEmail:
+		pref.Channel = ChannelEmail
+	case ChannelSMS:
+		if !pref.PhoneVerified {
+			return nil, errors.New("phone number not verified")
+		}
+		pref.Channel = ChannelSMS
+	case ChannelWebhook:
+		if pref.Webhook == "" {
+			return nil, errors.New("no webhook url")
+		}
+		pref.Channel = ChannelWebhook
+	default:
+		return nil, errors.New("unknown notification channel: " + channel)
+	}
+
+	if err := saveContactPreference(ctx, *pref); err != nil {
+		return nil, err
+	}
+	return pref, nil
+}
+
+// StartPhoneVerification texts a verification code to the phone number, in
+// E.164 form, which becomes the user's number once confirmed.
+func StartPhoneVerification(ctx context.Context, user users.User, phone string) error {
+	phone = strings.ReplaceAll(strings.TrimSpace(phone), " ", "")
+	if !phonePattern.MatchString(phone) {
+		return errors.New("phone number must be in international form, e.g. +15555550100")
+	}
+	pref, err := GetContactPreference(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	code := randomCode()
+	exp := time.Now().UTC().Add(15 * time.Minute)
+	pref.PendingPhone = phone
+	pref.PhoneCodeHash = hashToken(code)
+	pref.PhoneCodeExpires = &exp
+	pref.PhoneCodeTries = 0
+	if err := saveContactPreference(ctx, *pref); err != nil {
+		return err
+	}
+
+	return GetNotifier(ChannelSMS).Notify(ctx, phone, "phoneverify", "",
+		map[string]interface{}{"Code": code})
+}
+
+// ConfirmPhone makes the pending phone number the user's verified number.
+func ConfirmPhone(ctx context.Context, id primitive.ObjectID,
+	code string) (*ContactPreference, error) {
+	pref, err := GetContactPreference(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if pref.PendingPhone == "" || pref.PhoneCodeExpires == nil {
+		return nil, errors.New("no pending phone verification")
+	}
+	if time.Now().UTC().After(*pref.PhoneCodeExpires) {
+		return nil, errors.New("phone verification expired")
+	}
+	if !hmac.Equal([]byte(pref.PhoneCodeHash), []byte(hashToken(code))) {
+		pref.PhoneCodeTries++
+		if pref.PhoneCodeTries < maxPhoneCodeTries {
+			if err := saveContactPreference(ctx, *pref); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("bad verification code")
+		}
+		pref.PendingPhone = ""
+		pref.PhoneCodeHash = ""
+		pref.PhoneCodeExpires = nil
+		pref.PhoneCodeTries = 0
+		if err := saveContactPreference(ctx, *pref); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("too many bad codes, start the verification again")
+	}
+
+	pref.Phone = pref.PendingPhone
+	pref.PhoneVerified = true
+	pref.PendingPhone = ""
+	pref.PhoneCodeHash = ""
+	pref.PhoneCodeExpires = nil
+	pref.PhoneCodeTries = 0
+	if err := saveContactPreference(ctx, *pref); err != nil {
+		return nil, err
+	}
+	return pref, nil
+}
+
+// credentialTemplates are the notifications holding codes or links which give
+// access to the account.  Webhooks aren't verified as belonging to the user,
+// so these are never sent to one.
+var credentialTemplates = map[string]bool{
+	"reset":        true,
+	"invite":       true,
+	"emailconfirm": true,
+	"phoneverify":  true,
+}
+
+// NotifyUser sends the notification over the user's preferred channel,
+// falling back to email when that channel fails.  Notifications holding
+// credentials go by email rather than webhook.
+func NotifyUser(ctx context.Context, user users.User, template, application string,
+	data map[string]interface{}) error {
+	pref, err := GetContactPreference(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	recipient := ""
+	switch pref.Channel {
+	case ChannelSMS:
+		recipient = pref.Phone
+	case ChannelWebhook:
+		if !credentialTemplates[template] {
+			recipient = pref.Webhook
+		}
+	}
+	if recipient != "" {
+		notifyCtx, span := StartSpan(ctx, "notify",
+			attribute.String("notify.channel", pref.Channel),
+			attribute.String("notify.template", template))
+		err := GetNotifier(pref.Channel).Notify(notifyCtx, recipient, template,
+			application, data)
+		EndSpan(span, err)
+		if err == nil {
+			return nil
+		}
+		Logger.Warn("NotifyUser: channel failed, falling back to email",
+			"channel", pref.Channel, "error", err)
+	}
+	return GetNotifier(ChannelEmail).Notify(ctx, user.EmailAddress, template, application,
+		data)
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PasswordChangeToken is the restricted token given at login to a user whose
+// password has expired.  It can only be used to set a new password.
+type PasswordChangeToken struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userid"`
+	TokenHash string             `bson:"tokenHash"`
+	Expires   time.Time          `bson:"expires"`
+}
+
+// ExpiryNotice records the advance notices sent for a password expiration
+// date, so each notice is only sent once.
+type ExpiryNotice struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	Expires time.Time          `bson:"expires"`
+	Sent    []int              `bson:"sent"`
+}
+
+func getPasswordChangeCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "passwordchanges")
+}
+
+func getExpiryNoticeCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "expirynotices")
+}
+
+// SetUserPassword sets the user's password and its expiration date from the
+// maximum password age (PASSWORD_MAX_AGE_DAYS, default 90).
+func SetUserPassword(ctx context.Context, user *users.User, passwd string) {
+	_, span := StartSpan(ctx, "password.hash")
+	user.SetPassword(passwd)
+	EndSpan(span, nil)
+	user.PasswordExpires = time.Now().UTC().AddDate(0, 0,
+		GetSettings().Security.PasswordMaxAgeDays)
+}
+
+// VerifyPassword checks the password against the user's, counting a mismatch
+// in the user's bad attempts.
+func VerifyPassword(ctx context.Context, user *users.User, passwd string) error {
+	_, span := StartSpan(ctx, "password.verify")
+	err := user.Authenticate(passwd)
+	EndSpan(span, err)
+	return err
+}
+
+func IsPasswordExpired(user users.User) bool {
+	return !user.PasswordExpires.IsZero() &&
+		user.PasswordExpires.Before(time.Now().UTC())
+}
+
+// CreatePasswordChangeToken provides a short lived token allowing the user to
+// only change their expired password.
+func CreatePasswordChangeToken(ctx context.Context, user users.User) (string, error) {
+	token := RandomToken(32)
+	change := PasswordChangeToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		Expires:   time.Now().UTC().Add(15 * time.Minute),
+	}
+	if err := GetStores().Accounts.SavePasswordChange(ctx, change); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ChangeExpiredPassword sets a new password for the user holding a valid
+// password change token.  The token can only be used once, and not once the
+// account is deactivated or no longer active.
+func ChangeExpiredPassword(ctx context.Context, token,
+	passwd string) (*users.User, error) {
+	change, err := GetStores().Accounts.GetPasswordChange(ctx, hashToken(token))
+	if err != nil {
+		return nil, errors.New("invalid password change token")
+	}
+	if time.Now().UTC().After(change.Expires) {
+		return nil, errors.New("password change token expired")
+	}
+	if err := CheckAccountAccess(ctx, change.UserID); err != nil {
+		return nil, err
+	}
+	if err := ValidatePassword(passwd); err != nil {
+		return nil, err
+	}
+
+	user, err := GetStores().Users.GetByID(ctx, change.UserID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	SetUserPassword(ctx, user, passwd)
+	user.BadAttempts = 0
+	user.ResetToken = ""
+	user.ResetTokenExp = nil
+	if err := GetStores().Users.Update(ctx, *user); err != nil {
+		return nil, err
+	}
+
+	GetStores().Accounts.DeletePasswordChange(ctx, change.ID)
+	return user, nil
+}
+
+// getNoticeDays provides the days before expiration the notices are sent,
+// from PASSWORD_NOTICE_DAYS (default "14,7,1"), largest first.
+func getNoticeDays() []int {
+	days := append([]int(nil), GetSettings().Security.PasswordNoticeDays...)
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	return days
+}
+
+// SendPasswordExpiryNotices emails the users whose passwords expire within
+// one of the notice periods, returning the number of notices sent.  A notice
+// which can't be sent or recorded doesn't stop the others, and is tried again
+// on the next run.
+func SendPasswordExpiryNotices(ctx context.Context) (int, error) {
+	usrs, err := GetStores().Users.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	noticeDays := getNoticeDays()
+	if len(noticeDays) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	count := 0
+	var problems []error
+	for _, user := range usrs {
+		if user.PasswordExpires.IsZero() || user.PasswordExpires.Before(now) {
+			continue
+		}
+		if CheckAccountAccess(ctx, user.ID) != nil {
+			continue
+		}
+		daysLeft := int(user.PasswordExpires.Sub(now).Hours()/24) + 1
+
+		// the smallest period the user is within is the notice to send
+		notice := 0
+		for _, day := range noticeDays {
+			if daysLeft <= day {
+				notice = day
+			}
+		}
+		if notice == 0 {
+			continue
+		}
+
+		sent, err := GetStores().Accounts.GetExpiryNotice(ctx, user.ID)
+		if err != nil || !sent.Expires.Equal(user.PasswordExpires) {
+			sent = &ExpiryNotice{ID: user.ID, Expires: user.PasswordExpires}
+		}
+		alreadySent := false
+		for _, day := range sent.Sent {
+			if day <= notice {
+				alreadySent = true
+			}
+		}
+		if alreadySent {
+			continue
+		}
+
+		err = SendTemplateEmail(ctx, []string{user.EmailAddress}, "passwordexpiry", "",
+			map[string]interface{}{
+				"DaysLeft": daysLeft,
+				"Expires":  user.PasswordExpires.Format("01/02/06 15:04") + " UTC",
+			})
+		if err != nil {
+			problems = append(problems, fmt.Errorf("user %s: %w", user.ID.Hex(), err))
+			continue
+		}
+		count++
+
+		sent.Sent = append(sent.Sent, notice)
+		if err := GetStores().Accounts.SaveExpiryNotice(ctx, *sent); err != nil {
+			problems = append(problems, fmt.Errorf("user %s: %w", user.ID.Hex(), err))
+		}
+	}
+	return count, errors.Join(problems...)
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChangeExpiredPasswordAccess(t *testing.T) {
+	SetStores(NewMemoryStores())
+	ctx := context.Background()
+	user, err := GetStores().Users.Create(ctx, "expired@example.com", "Expired",
+		"", "User", "Correct-Horse-42")
+	if err != nil {
+		t.Fatalf("Create: %s", err.Error())
+	}
+	token, err := CreatePasswordChangeToken(ctx, *user)
+	if err != nil {
+		t.Fatalf("CreatePasswordChangeToken: %s", err.Error())
+	}
+
+	if err := SetAccountStatus(ctx, AccountStatus{ID: user.ID,
+		Status: StatusDisabled}); err != nil {
+		t.Fatalf("SetAccountStatus: %s", err.Error())
+	}
+	if _, err := ChangeExpiredPassword(ctx, token, "Battery-Staple-7"); err == nil {
+		t.Error("password of a disabled account changed")
+	}
+	unchanged, _ := GetStores().Users.GetByID(ctx, user.ID.Hex())
+	if unchanged.Authenticate("Correct-Horse-42") != nil {
+		t.Error("disabled account's password changed")
+	}
+
+	if err := SetAccountStatus(ctx, AccountStatus{ID: user.ID,
+		Status: StatusActive}); err != nil {
+		t.Fatalf("SetAccountStatus: %s", err.Error())
+	}
+	changed, err := ChangeExpiredPassword(ctx, token, "Battery-Staple-7")
+	if err != nil {
+		t.Fatalf("ChangeExpiredPassword: %s", err.Error())
+	}
+	if changed.Authenticate("Battery-Staple-7") != nil {
+		t.Error("password not changed")
+	}
+}
+
+// failingOutbox fails to queue the messages to the address.
+type failingOutbox struct {
+	OutboxStore
+	to string
+}
+
+func (s failingOutbox) Insert(ctx context.Context, msg OutboxMessage) error {
+	if msg.To[0] == s.to {
+		return errors.New("outbox unavailable")
+	}
+	return s.OutboxStore.Insert(ctx, msg)
+}
+
+func TestSendPasswordExpiryNotices(t *testing.T) {
+	SetStores(NewMemoryStores())
+	ctx := context.Background()
+	outbox := GetStores().Outbox
+	GetStores().Outbox = failingOutbox{OutboxStore: outbox, to: "failing@example.com"}
+	expires := time.Now().UTC().Add(36 * time.Hour)
+	// the notice which can't be queued mustn't stop the notices after it
+	for _, email := range []string{"failing@example.com", "expiring@example.com"} {
+		user := users.User{ID: primitive.NewObjectID(), EmailAddress: email,
+			PasswordExpires: expires}
+		if err := GetStores().Users.Insert(ctx, user); err != nil {
+			t.Fatalf("Insert: %s", err.Error())
+		}
+	}
+
+	count, err := SendPasswordExpiryNotices(ctx)
+	if count != 1 || err == nil {
+		t.Fatalf("sent %d, error %v, want 1 and the failure", count, err)
+	}
+	msgs, _ := outbox.Find(ctx, "", 10)
+	if len(msgs) != 1 || msgs[0].To[0] != "expiring@example.com" {
+		t.Fatalf("queued = %+v", msgs)
+	}
+
+	// only the failed notice is tried again
+	GetStores().Outbox = outbox
+	if count, err := SendPasswordExpiryNotices(ctx); count != 1 || err != nil {
+		t.Errorf("second run sent %d, error %v, want 1", count, err)
+	}
+	if count, _ := SendPasswordExpiryNotices(ctx); count != 0 {
+		t.Errorf("notices sent again, %d sent", count)
+	}
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+// ValidatePassword checks a new password against the password policy: a
+// minimum length (PASSWORD_MIN_LENGTH, default 10) and at least one upper
+// case letter, lower case letter and digit.
+func ValidatePassword(passwd string) error {
+	minLength := GetSettings().Security.PasswordMinLength
+	if len(passwd) < minLength {
+		return fmt.Errorf("password must be at least %d characters", minLength)
+	}
+
+	var upper, lower, digit bool
+	for _, r := range passwd {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !upper || !lower || !digit {
+		return errors.New("password must contain upper case, lower case and " +
+			"numeric characters")
+	}
+	return nil
+}
+
+// RandomToken provides a random hex string of the number of bytes given, used
+// for invitation tokens and for the unusable password of users who haven't set
+// their own.
+func RandomToken(size int) string {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// hashToken provides the hash stored in place of a token or code sent to a
+// user, so the database never holds a usable value.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secrets may be kept out of the environment and the settings file in two
+// ways.  Any variable can instead be given as <NAME>_FILE, the path of a file
+// holding the value, as Docker and Kubernetes mount secrets.  And any text
+// setting can be encrypted, given as "enc:" followed by the output of the
+// encrypt command, which is decrypted with the master key from
+// SETTINGS_MASTER_KEY or the file named by SETTINGS_MASTER_KEY_FILE.
+
+const encryptedPrefix = "enc:"
+
+// getMasterKey provides the AES-256 key derived from the master key.
+func getMasterKey() ([]byte, error) {
+	master := os.Getenv("SETTINGS_MASTER_KEY")
+	if path := os.Getenv("SETTINGS_MASTER_KEY_FILE"); master == "" && path != "" {
+		var err error
+		if master, err = readSecretFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if master == "" {
+		return nil, errors.New("no master key, set SETTINGS_MASTER_KEY or SETTINGS_MASTER_KEY_FILE")
+	}
+	key := sha256.Sum256([]byte(master))
+	return key[:], nil
+}
+
+func newSettingsCipher() (cipher.AEAD, error) {
+	key, err := getMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return newCipher(key)
+}
+
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the value, providing the nonce and sealed value in base64.
+func seal(gcm cipher.AEAD, value []byte) (string, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, value, nil)), nil
+}
+
+// unseal provides the value sealed by seal.
+func unseal(gcm cipher.AEAD, value string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is malformed")
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// EncryptSetting encrypts the value with the master key for use in the
+// settings file or environment.
+func EncryptSetting(value string) (string, error) {
+	gcm, err := newSettingsCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(gcm, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + sealed, nil
+}
+
+// decryptSetting provides the plain value of an encrypted setting.  Values
+// without the prefix are returned unchanged.
+func decryptSetting(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	gcm, err := newSettingsCipher()
+	if err != nil {
+		return "", err
+	}
+	plain, err := unseal(gcm, strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", errors.New("encrypted value can't be decrypted with the master key")
+	}
+	return string(plain), nil
+}
+
+// secretKeyID identifies a key in the records sealed or signed with it,
+// without revealing the key.
+func secretKeyID(key string) string {
+	sum := sha256.Sum256([]byte("id:" + key))
+	return hex.EncodeToString(sum[:4])
+}
+
+func newDataKeyCipher(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte("data:" + key))
+	return newCipher(sum[:])
+}
+
+// newDataCipher provides the cipher for data the service keeps encrypted in
+// the database, such as queued email, keyed from SECURITY_KEY, with the id of
+// the key to store with the sealed data.
+func newDataCipher() (cipher.AEAD, string, error) {
+	key := GetSettings().Security.SecurityKey
+	if key == "" {
+		return nil, "", errors.New("no security key, set SECURITY_KEY")
+	}
+	gcm, err := newDataKeyCipher(key)
+	return gcm, secretKeyID(key), err
+}
+
+// getDataCipher provides the cipher for data sealed with the key of the id,
+// the current SECURITY_KEY or the previous one, SECURITY_KEY_PREVIOUS, so the
+// data sealed before the key was rotated can still be read.
+func getDataCipher(id string) (cipher.AEAD, error) {
+	security := GetSettings().Security
+	for _, key := range []string{security.SecurityKey, security.PreviousSecurityKey} {
+		if key != "" && secretKeyID(key) == id {
+			return newDataKeyCipher(key)
+		}
+	}
+	return nil, fmt.Errorf("no security key with id %q", id)
+}
+
+// readSecretFile provides the contents of a secret file without the trailing
+// line break most editors and tools add.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("secret file: %s", err.Error())
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptSetting(t *testing.T) {
+	t.Setenv("SETTINGS_MASTER_KEY", "master-key-one")
+	t.Setenv("SETTINGS_MASTER_KEY_FILE", "")
+
+	encrypted, err := EncryptSetting("mongodb://user:pass@db")
+	if err != nil {
+		t.Fatalf("EncryptSetting: %s", err.Error())
+	}
+	if !strings.HasPrefix(encrypted, encryptedPrefix) ||
+		strings.Contains(encrypted, "pass@db") {
+		t.Fatalf("encrypted value = %q", encrypted)
+	}
+	plain, err := decryptSetting(encrypted)
+	if err != nil {
+		t.Fatalf("decryptSetting: %s", err.Error())
+	}
+	if plain != "mongodb://user:pass@db" {
+		t.Errorf("decrypted value = %q", plain)
+	}
+
+	again, _ := EncryptSetting("mongodb://user:pass@db")
+	if again == encrypted {
+		t.Error("same value encrypted the same twice")
+	}
+
+	t.Setenv("SETTINGS_MASTER_KEY", "master-key-two")
+	if _, err := decryptSetting(encrypted); err == nil {
+		t.Error("decrypted with the wrong master key")
+	}
+}
+
+func TestDecryptSettingPlain(t *testing.T) {
+	t.Setenv("SETTINGS_MASTER_KEY", "")
+	t.Setenv("SETTINGS_MASTER_KEY_FILE", "")
+
+	plain, err := decryptSetting("not encrypted")
+	if err != nil || plain != "not encrypted" {
+		t.Errorf("decryptSetting = %q, %v", plain, err)
+	}
+	if _, err := decryptSetting(encryptedPrefix + "abc"); err == nil {
+		t.Error("decrypted without a master key")
+	}
+	if _, err := EncryptSetting("value"); err == nil {
+		t.Error("encrypted without a master key")
+	}
+}
+
+func TestDataCipherRotation(t *testing.T) {
+	previous := GetSettings()
+	defer currentSettings.Store(previous)
+	settings := *previous
+	settings.Security.SecurityKey = "key-one"
+	currentSettings.Store(&settings)
+
+	gcm, id, err := newDataCipher()
+	if err != nil {
+		t.Fatalf("newDataCipher: %s", err.Error())
+	}
+	sealed, _ := seal(gcm, []byte("queued message"))
+
+	rotated := settings
+	rotated.Security.SecurityKey = "key-two"
+	rotated.Security.PreviousSecurityKey = "key-one"
+	currentSettings.Store(&rotated)
+	if _, current, _ := newDataCipher(); current == id {
+		t.Error("the rotated key has the same id")
+	}
+	gcm, err = getDataCipher(id)
+	if err != nil {
+		t.Fatalf("getDataCipher with the previous key: %s", err.Error())
+	}
+	if plain, err := unseal(gcm, sealed); err != nil || string(plain) != "queued message" {
+		t.Errorf("unseal = %q, %v", plain, err)
+	}
+
+	rotated.Security.PreviousSecurityKey = ""
+	if _, err := getDataCipher(id); err == nil {
+		t.Error("opened data sealed with a key no longer kept")
+	}
+}
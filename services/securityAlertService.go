@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/erneap/go-models/config"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// IsAdminRole reports whether the workgroup is one of the admin roles.
+func IsAdminRole(workgroup string) bool {
+	for _, role := range GetSettings().Security.AdminRoles {
+		if strings.EqualFold(role, workgroup) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	AlertNewDevice      = "newdevice"
+	AlertLockout        = "lockout"
+	AlertPasswordChange = "passwordchange"
+	AlertEmailChange    = "emailchange"
+	AlertAdminGrant     = "admingrant"
+)
+
+// AlertSetting controls who is notified for a type of security event.  The
+// site admins notified are the addresses in SECURITY_ADMIN_EMAILS.
+type AlertSetting struct {
+	Event        string `json:"event" bson:"_id"`
+	Title        string `json:"title" bson:"title"`
+	Enabled      bool   `json:"enabled" bson:"enabled"`
+	NotifyUser   bool   `json:"notifyUser" bson:"notifyUser"`
+	NotifyAdmins bool   `json:"notifyAdmins" bson:"notifyAdmins"`
+}
+
+var defaultAlertSettings = []AlertSetting{
+	{Event: AlertNewDevice, Title: "New sign-in location", Enabled: true,
+		NotifyUser: true},
+	{Event: AlertLockout, Title: "Account locked", Enabled: true,
+		NotifyUser: true, NotifyAdmins: true},
+	{Event: AlertPasswordChange, Title: "Password changed", Enabled: true,
+		NotifyUser: true},
+	{Event: AlertEmailChange, Title: "Email address changed", Enabled: true,
+		NotifyUser: true},
+	{Event: AlertAdminGrant, Title: "Administrator access granted", Enabled: true,
+		NotifyUser: true, NotifyAdmins: true},
+}
+
+// SecurityEvent is an authentication event which may warrant an alert.
+type SecurityEvent struct {
+	Type        string
+	User        users.User
+	Application string
+	IPAddress   string
+	UserAgent   string
+	Description string
+}
+
+// KnownDevice is an IP address and user agent the user has logged in from.
+type KnownDevice struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	UserID    primitive.ObjectID `json:"userid" bson:"userid"`
+	IPAddress string             `json:"ipAddress" bson:"ipAddress"`
+	UserAgent string             `json:"userAgent" bson:"userAgent"`
+	FirstSeen time.Time          `json:"firstSeen" bson:"firstSeen"`
+	LastSeen  time.Time          `json:"lastSeen" bson:"lastSeen"`
+}
+
+func getAlertSettingCollection() *mongo.Collection {
+	return config.GetCollection(config.DB, "authenticate", "alertsettings")
+}
+
+// GetAlertSettings provides the settings for every event type, with the
+// defaults for those not stored.
+func GetAlertSettings(ctx context.Context) ([]AlertSetting, error) {
+	stored, err := GetStores().Notifications.GetAlertSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []AlertSetting
+	for _, def := range defaultAlertSettings {
+		setting := def
+		for _, s := range stored {
+			if s.Event == def.Event {
+				setting = s
+				setting.Title = def.Title
+			}
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+func GetAlertSetting(ctx context.Context, event string) (*AlertSetting, error) {
+	settings, err := GetAlertSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		if s.Event == event {
+			return &s, nil
+		}
+	}
+	return nil, errors.New("unknown security event: " + event)
+}
+
+func UpdateAlertSetting(ctx context.Context, setting AlertSetting) error {
+	current, err := GetAlertSetting(ctx, setting.Event)
+	if err != nil {
+		return err
+	}
+	setting.Title = current.Title
+	return GetStores().Notifications.SaveAlertSetting(ctx, setting)
+}
+
+// RaiseSecurityAlert notifies the user and site admins of the event, as its
+// setting allows.  Notifications are sent in the background so a slow channel
+// doesn't hold up the request.
+func RaiseSecurityAlert(ctx context.Context, evt SecurityEvent) {
+	setting, err := GetAlertSetting(ctx, evt.Type)
+	if err != nil {
+		Logger.Error("RaiseSecurityAlert: setting problem", "event", evt.Type,
+			"error", err)
+		return
+	}
+	if !setting.Enabled {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":       setting.Title,
+		"Description": evt.Description,
+		"Account":     evt.User.EmailAddress,
+		"Time":        time.Now().UTC().Format("01/02/06 15:04") + " UTC",
+		"IPAddress":   evt.IPAddress,
+		"UserAgent":   evt.UserAgent,
+	}
+	// the notifications outlive the request which raised the alert
+	ctx = context.WithoutCancel(ctx)
+	RunInBackground(func() {
+		if setting.NotifyUser {
+			err := NotifyUser(ctx, evt.User, "securityalert", evt.Application, data)
+			if err != nil {
+				Logger.Error("RaiseSecurityAlert: user notification problem",
+					"event", evt.Type, "error", err)
+			}
+		}
+		if setting.NotifyAdmins {
+			admins := GetSettings().Security.AdminEmails
+			if len(admins) > 0 {
+				err := SendTemplateEmail(ctx, admins, "securityalert", evt.Application, data)
+				if err != nil {
+					Logger.Error("RaiseSecurityAlert: admin notification problem",
+						"event", evt.Type, "error", err)
+				}
+			}
+		}
+	})
+}
+
+// CheckLoginDevice records the IP address and user agent of a successful login
+// and raises a new device alert when the user hasn't used them before.  A
+// user's first recorded login doesn't raise an alert.
+func CheckLoginDevice(ctx context.Context, user users.User, application, ip,
+	userAgent string) {
+	isNew, hadOthers, err := GetStores().Sessions.TouchDevice(ctx, user.ID, ip,
+		userAgent, time.Now().UTC())
+	if err != nil {
+		Logger.Error("CheckLoginDevice problem", "userid", user.ID.Hex(),
+			"error", err)
+		return
+	}
+	if isNew && hadOthers {
+		RaiseSecurityAlert(ctx, SecurityEvent{
+			Type:        AlertNewDevice,
+			User:        user,
+			Application: application,
+			IPAddress:   ip,
+			UserAgent:   userAgent,
+			Description: "Your account was signed in to from a new location or browser.",
+		})
+	}
+}
+
+// IsLockedOut reports whether the user's failed logins have reached the
+// lockout threshold (LOCKOUT_ATTEMPTS, default 5).  The service enforces the
+// threshold itself before checking the password, so the lockout and its
+// alert always agree whatever go-models allows.
+func IsLockedOut(user users.User) bool {
+	return user.BadAttempts >= GetSettings().Security.LockoutAttempts
+}
+
+// CheckLockout raises a lockout alert when a failed login takes the user from
+// below the lockout threshold, given the failed attempts before it, to the
+// threshold or beyond.
+func CheckLockout(ctx context.Context, user users.User, before int,
+	application, ip, userAgent string) {
+	if before >= GetSettings().Security.LockoutAttempts || !IsLockedOut(user) {
+		return
+	}
+	LockoutCount.Inc()
+	RaiseSecurityAlert(ctx, SecurityEvent{
+		Type:        AlertLockout,
+		User:        user,
+		Application: application,
+		IPAddress:   ip,
+		UserAgent:   userAgent,
+		Description: "Your account was locked after repeated failed sign-in attempts.",
+	})
+}
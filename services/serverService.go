@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/erneap/go-models/config"
+)
+
+// NewHTTPServer provides the server for the handler, configured by
+// LISTEN_ADDR (default ":6000"), HTTP_READ_TIMEOUT, HTTP_READ_HEADER_TIMEOUT,
+// HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT in seconds, and
+// HTTP_MAX_HEADER_BYTES.
+func NewHTTPServer(handler http.Handler) *http.Server {
+	settings := GetSettings().Server
+	seconds := func(value int) time.Duration {
+		return time.Duration(value) * time.Second
+	}
+	return &http.Server{
+		Addr:              settings.Listen,
+		Handler:           handler,
+		ReadTimeout:       seconds(settings.ReadTimeoutSeconds),
+		ReadHeaderTimeout: seconds(settings.ReadHeaderTimeoutSeconds),
+		WriteTimeout:      seconds(settings.WriteTimeoutSeconds),
+		IdleTimeout:       seconds(settings.IdleTimeoutSeconds),
+		MaxHeaderBytes:    settings.MaxHeaderBytes,
+	}
+}
+
+// Shutdown stops the service within SHUTDOWN_TIMEOUT seconds (default 30):
+// the servers stop accepting connections and drain the requests in flight,
+// the background jobs and notifications finish, queued email is given a last
+// delivery attempt in the time left and the database is disconnected.
+func Shutdown(servers ...*http.Server) {
+	timeout := time.Duration(GetSettings().Server.ShutdownTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			Logger.Error("Shutdown: server problem", "addr", server.Addr, "error", err)
+		}
+	}
+	if err := StopJobs(ctx); err != nil {
+		Logger.Error("Shutdown: background jobs still running", "error", err)
+	}
+	if config.DB == nil {
+		return
+	}
+	if count, err := ProcessOutbox(ctx); err != nil {
+		Logger.Error("Shutdown: ProcessOutbox problem", "error", err)
+	} else if count > 0 {
+		Logger.Info("Shutdown: sent queued email", "count", count)
+	}
+	if err := config.DB.Disconnect(ctx); err != nil {
+		Logger.Error("Shutdown: database disconnect problem", "error", err)
+	}
+}
@@ -0,0 +1,27 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	err := LoadSettings([]string{
+		"-mongo.uri=mongodb://localhost",
+		"-security.jwtSecret=test-jwt-secret",
+		"-security.securityKey=test-security-key",
+		"-audit.signingKey=test-audit-signing-key",
+		"-audit.archiveDir=/var/log/authenticate",
+		"-users.inviteUrl=https://auth.example.com/invite",
+		"-users.emailConfirmUrl=https://auth.example.com/email/confirm",
+		"-users.emailRevertUrl=https://auth.example.com/email/revert",
+		"-email.transport=memory",
+		"-email.from=noreply@example.com",
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "settings problem: %s\n", err.Error())
+		os.Exit(2)
+	}
+	os.Exit(m.Run())
+}
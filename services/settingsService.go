@@ -0,0 +1,722 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings is the service's configuration.  Each value is taken from, in
+// rising precedence, its default, the file named by the -config flag or
+// CONFIG_FILE, its environment variable and its command line flag, which is
+// the section and key, e.g. -server.listen=:6000.  The file is TOML when its
+// name ends in .toml and YAML otherwise, with the same section and key names;
+// TOML keys are matched to the fields without regard to case.  Lists are comma
+// separated in the environment and on the command line.  Secrets can be given
+// in files or encrypted, and are re-read every SETTINGS_RELOAD_SECONDS (0 to
+// disable).
+type Settings struct {
+	Server   ServerSettings   `yaml:"server"`
+	TLS      TLSSettings      `yaml:"tls"`
+	Mongo    MongoSettings    `yaml:"mongo"`
+	Security SecuritySettings `yaml:"security"`
+	Users    UserSettings     `yaml:"users"`
+	Email    EmailSettings    `yaml:"email"`
+	Notify   NotifySettings   `yaml:"notify"`
+	Audit    AuditSettings    `yaml:"audit"`
+	Logging  LoggingSettings  `yaml:"logging"`
+	Tracing  TracingSettings  `yaml:"tracing"`
+	Metrics  MetricsSettings  `yaml:"metrics"`
+}
+
+type ServerSettings struct {
+	Listen                   string `yaml:"listen" env:"LISTEN_ADDR"`
+	ReadTimeoutSeconds       int    `yaml:"readTimeoutSeconds" env:"HTTP_READ_TIMEOUT"`
+	ReadHeaderTimeoutSeconds int    `yaml:"readHeaderTimeoutSeconds" env:"HTTP_READ_HEADER_TIMEOUT"`
+	WriteTimeoutSeconds      int    `yaml:"writeTimeoutSeconds" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeoutSeconds       int    `yaml:"idleTimeoutSeconds" env:"HTTP_IDLE_TIMEOUT"`
+	MaxHeaderBytes           int    `yaml:"maxHeaderBytes" env:"HTTP_MAX_HEADER_BYTES"`
+	ShutdownTimeoutSeconds   int    `yaml:"shutdownTimeoutSeconds" env:"SHUTDOWN_TIMEOUT"`
+	SettingsReloadSeconds    int    `yaml:"settingsReloadSeconds" env:"SETTINGS_RELOAD_SECONDS"`
+}
+
+type TLSSettings struct {
+	CertFile         string            `yaml:"certFile" env:"TLS_CERT_FILE"`
+	KeyFile          string            `yaml:"keyFile" env:"TLS_KEY_FILE"`
+	ClientCAFile     string            `yaml:"clientCaFile" env:"TLS_CLIENT_CA_FILE"`
+	MinVersion       string            `yaml:"minVersion" env:"TLS_MIN_VERSION"`
+	ReloadSeconds    int               `yaml:"reloadSeconds" env:"TLS_RELOAD_SECONDS"`
+	ClientIdentities map[string]string `yaml:"clientIdentities" env:"TLS_CLIENT_IDENTITIES" sep:";"`
+	MTLSRoutes       []string          `yaml:"mtlsRoutes" env:"MTLS_ROUTES"`
+}
+
+type MongoSettings struct {
+	URI string `yaml:"uri" env:"MONGO_URI,MONGOURI" secret:"true"`
+}
+
+type SecuritySettings struct {
+	JWTSecret           string   `yaml:"jwtSecret" env:"JWT_SECRET" secret:"true"`
+	InviteSecret        string   `yaml:"inviteSecret" env:"INVITE_SECRET" secret:"true"`
+	SecurityKey         string   `yaml:"securityKey" env:"SECURITY_KEY" secret:"true"`
+	PreviousSecurityKey string   `yaml:"previousSecurityKey" env:"SECURITY_KEY_PREVIOUS" secret:"true"`
+	AdminRoles          []string `yaml:"adminRoles" env:"ADMIN_ROLES"`
+	AdminEmails         []string `yaml:"adminEmails" env:"SECURITY_ADMIN_EMAILS"`
+	LockoutAttempts     int      `yaml:"lockoutAttempts" env:"LOCKOUT_ATTEMPTS"`
+	PasswordMinLength   int      `yaml:"passwordMinLength" env:"PASSWORD_MIN_LENGTH"`
+	PasswordMaxAgeDays  int      `yaml:"passwordMaxAgeDays" env:"PASSWORD_MAX_AGE_DAYS"`
+	PasswordNoticeDays  []int    `yaml:"passwordNoticeDays" env:"PASSWORD_NOTICE_DAYS"`
+	ResetExpiryMinutes  int      `yaml:"resetExpiryMinutes" env:"RESET_EXPIRY_MINUTES"`
+}
+
+type UserSettings struct {
+	RetentionDays            int    `yaml:"retentionDays" env:"USER_RETENTION_DAYS"`
+	InviteExpiryHours        int    `yaml:"inviteExpiryHours" env:"INVITE_EXPIRY_HOURS"`
+	InviteURL                string `yaml:"inviteUrl" env:"INVITE_URL"`
+	EmailChangeExpiryMinutes int    `yaml:"emailChangeExpiryMinutes" env:"EMAIL_CHANGE_EXPIRY_MINUTES"`
+	EmailConfirmURL          string `yaml:"emailConfirmUrl" env:"EMAIL_CONFIRM_URL"`
+	EmailRevertDays          int    `yaml:"emailRevertDays" env:"EMAIL_REVERT_DAYS"`
+	EmailRevertURL           string `yaml:"emailRevertUrl" env:"EMAIL_REVERT_URL"`
+}
+
+type EmailSettings struct {
+	Transport    string `yaml:"transport" env:"EMAIL_TRANSPORT"`
+	FileDir      string `yaml:"fileDir" env:"EMAIL_FILE_DIR"`
+	SMTPServer   string `yaml:"smtpServer" env:"SMTP_SERVER"`
+	SMTPPort     string `yaml:"smtpPort" env:"SMTP_PORT"`
+	From         string `yaml:"from" env:"SMTP_FROM"`
+	MaxAttempts  int    `yaml:"maxAttempts" env:"EMAIL_MAX_ATTEMPTS"`
+	QueueSeconds int    `yaml:"queueSeconds" env:"EMAIL_QUEUE_SECONDS"`
+	TemplateDir  string `yaml:"templateDir" env:"EMAIL_TEMPLATE_DIR"`
+	SchedulerURL string `yaml:"schedulerUrl" env:"SCHEDULER_URL"`
+	MetricsURL   string `yaml:"metricsUrl" env:"METRICS_URL"`
+}
+
+type NotifySettings struct {
+	SMSGatewayURL   string `yaml:"smsGatewayUrl" env:"SMS_GATEWAY_URL"`
+	SMSGatewayToken string `yaml:"smsGatewayToken" env:"SMS_GATEWAY_TOKEN" secret:"true"`
+	WebhookSecret   string `yaml:"webhookSecret" env:"WEBHOOK_SECRET" secret:"true"`
+}
+
+type AuditSettings struct {
+	SigningKey          string            `yaml:"signingKey" env:"AUDIT_SIGNING_KEY" secret:"true"`
+	PreviousSigningKeys []string          `yaml:"previousSigningKeys" env:"AUDIT_SIGNING_KEY_PREVIOUS" secret:"true"`
+	CheckpointMinutes   int               `yaml:"checkpointMinutes" env:"AUDIT_CHECKPOINT_MINUTES"`
+	Retention           map[string]string `yaml:"retention" env:"AUDIT_RETENTION"`
+	ExportLimit         int               `yaml:"exportLimit" env:"AUDIT_EXPORT_LIMIT"`
+	ArchiveDir          string            `yaml:"archiveDir" env:"LOG_DIR"`
+}
+
+type LoggingSettings struct {
+	Level string `yaml:"level" env:"LOGLEVEL"`
+}
+
+type TracingSettings struct {
+	Exporter    string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	File        string `yaml:"file" env:"OTEL_TRACES_FILE"`
+	ServiceName string `yaml:"serviceName" env:"OTEL_SERVICE_NAME"`
+}
+
+type MetricsSettings struct {
+	Addr  string `yaml:"addr" env:"METRICS_ADDR"`
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+// DefaultSettings provides the settings used when nothing else is given.
+func DefaultSettings() *Settings {
+	return &Settings{
+		Server: ServerSettings{
+			Listen:                   ":6000",
+			ReadTimeoutSeconds:       15,
+			ReadHeaderTimeoutSeconds: 5,
+			WriteTimeoutSeconds:      30,
+			IdleTimeoutSeconds:       120,
+			MaxHeaderBytes:           1 << 20,
+			ShutdownTimeoutSeconds:   30,
+			SettingsReloadSeconds:    60,
+		},
+		TLS: TLSSettings{
+			MinVersion:    "1.2",
+			ReloadSeconds: 60,
+		},
+		Security: SecuritySettings{
+			AdminRoles: []string{"metrics-admin", "scheduler-scheduler",
+				"scheduler-siteleader", "scheduler-teamleader", "scheduler-admin"},
+			LockoutAttempts:    5,
+			PasswordMinLength:  10,
+			PasswordMaxAgeDays: 90,
+			PasswordNoticeDays: []int{14, 7, 1},
+			ResetExpiryMinutes: 30,
+		},
+		Users: UserSettings{
+			RetentionDays:            90,
+			InviteExpiryHours:        72,
+			EmailChangeExpiryMinutes: 60,
+			EmailRevertDays:          7,
+		},
+		Email: EmailSettings{
+			Transport:    "smtp",
+			FileDir:      filepath.Join(os.TempDir(), "mail"),
+			SMTPServer:   "localhost",
+			SMTPPort:     "25",
+			MaxAttempts:  8,
+			QueueSeconds: 10,
+		},
+		Audit: AuditSettings{
+			CheckpointMinutes: 60,
+			ExportLimit:       50000,
+		},
+		Logging: LoggingSettings{Level: "info"},
+		Tracing: TracingSettings{
+			Exporter:    "none",
+			File:        "traces.json",
+			ServiceName: "authentication",
+		},
+	}
+}
+
+// sharedEnv are the variables read by the shared go-models packages, which
+// are set from the settings so that they agree with the service.
+var sharedEnv = []string{"MONGO_URI", "JWT_SECRET", "SECURITY_KEY", "SMTP_SERVER",
+	"SMTP_PORT", "SMTP_FROM", "LOGLEVEL"}
+
+// settingField is one value of the settings with where it comes from.
+type settingField struct {
+	name   string // section.key
+	env    []string
+	secret bool
+	sep    string
+	value  reflect.Value
+}
+
+func (s *Settings) fields() []settingField {
+	var fields []settingField
+	root := reflect.ValueOf(s).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i)
+		group := root.Field(i)
+		for j := 0; j < group.NumField(); j++ {
+			field := group.Type().Field(j)
+			sep := field.Tag.Get("sep")
+			if sep == "" {
+				sep = ","
+			}
+			fields = append(fields, settingField{
+				name:   section.Tag.Get("yaml") + "." + field.Tag.Get("yaml"),
+				env:    strings.Split(field.Tag.Get("env"), ","),
+				secret: field.Tag.Get("secret") == "true",
+				sep:    sep,
+				value:  group.Field(j),
+			})
+		}
+	}
+	return fields
+}
+
+// set parses the text into the field, lists and maps being separated by the
+// field's separator.
+func (f settingField) set(text string) error {
+	text = strings.TrimSpace(text)
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(text)
+	case reflect.Int:
+		i, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", text)
+		}
+		f.value.SetInt(int64(i))
+	case reflect.Slice:
+		items := reflect.MakeSlice(f.value.Type(), 0, 0)
+		for _, item := range strings.Split(text, f.sep) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			if f.value.Type().Elem().Kind() == reflect.Int {
+				i, err := strconv.Atoi(item)
+				if err != nil {
+					return fmt.Errorf("%q is not a number", item)
+				}
+				items = reflect.Append(items, reflect.ValueOf(i))
+			} else {
+				items = reflect.Append(items, reflect.ValueOf(item))
+			}
+		}
+		f.value.Set(items)
+	case reflect.Map:
+		items := make(map[string]string)
+		for _, item := range strings.Split(text, f.sep) {
+			pos := strings.LastIndex(item, "=")
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			if pos <= 0 {
+				return fmt.Errorf("%q is not key=value", item)
+			}
+			items[strings.TrimSpace(item[:pos])] = strings.TrimSpace(item[pos+1:])
+		}
+		f.value.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// String provides the field's value as it would be given in the environment.
+func (f settingField) String() string {
+	switch f.value.Kind() {
+	case reflect.Slice:
+		var items []string
+		for i := 0; i < f.value.Len(); i++ {
+			items = append(items, fmt.Sprint(f.value.Index(i).Interface()))
+		}
+		return strings.Join(items, f.sep)
+	case reflect.Map:
+		var items []string
+		for _, key := range f.value.MapKeys() {
+			items = append(items, key.String()+"="+f.value.MapIndex(key).String())
+		}
+		sort.Strings(items)
+		return strings.Join(items, f.sep)
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+var (
+	currentSettings atomic.Pointer[Settings]
+	settingsMutex   sync.Mutex
+	settingsFile    string
+	settingsFlags   map[string]string
+	settingsSources map[string]string
+)
+
+// GetSettings provides the loaded settings.  Before LoadSettings the defaults
+// with the environment are used, unvalidated.
+func GetSettings() *Settings {
+	if settings := currentSettings.Load(); settings != nil {
+		return settings
+	}
+	settings, _, err := readSettings("", nil)
+	if err != nil {
+		Logger.Warn("settings problem", "error", err)
+	}
+	currentSettings.CompareAndSwap(nil, settings)
+	return currentSettings.Load()
+}
+
+// LoadSettings reads the settings with the command line arguments, validates
+// them and makes them current.  Every problem found is reported in the error.
+func LoadSettings(args []string) error {
+	fs := flag.NewFlagSet("authentication", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML settings file")
+	flags := make(map[string]string)
+	for _, field := range DefaultSettings().fields() {
+		name := field.name
+		fs.Func(name, "overrides "+strings.Join(field.env, " or "), func(value string) error {
+			flags[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	settingsFile = *file
+	settingsFlags = flags
+	_, err := applySettings()
+	return err
+}
+
+// ReloadSettings reads the settings again, picking up changes to the settings
+// file, secret files and encrypted values, and makes them current when they
+// are valid.  Settings used only at startup, such as the listen address, need
+// a restart.  So does a changed MongoDB URI, as the shared go-models packages
+// use the client in config.DB without synchronization, so it can't be
+// replaced while the service runs.
+func ReloadSettings() error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	changed, err := applySettings()
+	if err != nil || len(changed) == 0 {
+		return err
+	}
+	Logger.Info("settings reloaded", "changed", strings.Join(changed, ","))
+	for _, name := range changed {
+		if name == "mongo.uri" {
+			Logger.Warn("the MongoDB URI changed, restart to connect with it")
+		}
+	}
+	return nil
+}
+
+// applySettings reads and validates the settings and makes them current,
+// providing the names of the values which changed.  The caller holds
+// settingsMutex.
+func applySettings() ([]string, error) {
+	settings, sources, err := readSettings(settingsFile, settingsFlags)
+	if err != nil {
+		return nil, err
+	}
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	previous := currentSettings.Load()
+	if previous == nil {
+		previous = DefaultSettings()
+	}
+	before := make(map[string]string)
+	for _, field := range previous.fields() {
+		before[field.name] = field.String()
+	}
+	for _, field := range settings.fields() {
+		if before[field.name] != field.String() {
+			changed = append(changed, field.name)
+		}
+		for _, name := range sharedEnv {
+			if field.env[0] == name && field.String() != "" {
+				os.Setenv(name, field.String())
+			}
+		}
+	}
+	settingsSources = sources
+	currentSettings.Store(settings)
+	return changed, nil
+}
+
+var (
+	startupEnv     map[string]string
+	startupEnvOnce sync.Once
+)
+
+// getStartupEnv provides the variable from the environment as it was when the
+// settings were first read.  The shared variables set from the settings would
+// otherwise hide later changes to the settings file and secret files.
+func getStartupEnv(name string) string {
+	startupEnvOnce.Do(func() {
+		startupEnv = make(map[string]string)
+		for _, item := range os.Environ() {
+			if pos := strings.Index(item, "="); pos > 0 {
+				startupEnv[item[:pos]] = item[pos+1:]
+			}
+		}
+	})
+	return startupEnv[name]
+}
+
+// readSettings builds the settings from the defaults, file, environment and
+// flags in that order, noting where each value came from, and decrypts the
+// encrypted values.
+func readSettings(file string, flags map[string]string) (*Settings, map[string]string, error) {
+	settings := DefaultSettings()
+	sources := make(map[string]string)
+	inFile := make(map[string]bool)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("settings file: %s", err.Error())
+		}
+		var keys map[string]map[string]interface{}
+		if strings.EqualFold(filepath.Ext(file), ".toml") {
+			decoder := toml.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(settings); err != nil {
+				var strict *toml.StrictMissingError
+				if errors.As(err, &strict) {
+					return nil, nil, fmt.Errorf("settings file %s: unknown keys\n%s", file,
+						strict.String())
+				}
+				return nil, nil, fmt.Errorf("settings file %s: %s", file, err.Error())
+			}
+			err = toml.Unmarshal(data, &keys)
+		} else {
+			decoder := yaml.NewDecoder(bytes.NewReader(data))
+			decoder.KnownFields(true)
+			if err := decoder.Decode(settings); err != nil {
+				return nil, nil, fmt.Errorf("settings file %s: %s", file, err.Error())
+			}
+			err = yaml.Unmarshal(data, &keys)
+		}
+		if err == nil {
+			for section, values := range keys {
+				for key := range values {
+					inFile[section+"."+key] = true
+				}
+			}
+		}
+	}
+
+	var problems []error
+	for _, field := range settings.fields() {
+		sources[field.name] = "default"
+		if inFile[field.name] {
+			sources[field.name] = "file"
+		}
+		for _, name := range field.env {
+			value, source := getStartupEnv(name), "env:"+name
+			if path := getStartupEnv(name + "_FILE"); value == "" && path != "" {
+				var err error
+				if value, err = readSecretFile(path); err != nil {
+					problems = append(problems, fmt.Errorf("%s_FILE: %s", name, err.Error()))
+					continue
+				}
+				source = "env:" + name + "_FILE"
+			}
+			if value != "" {
+				if err := field.set(value); err != nil {
+					problems = append(problems, fmt.Errorf("%s: %s", name, err.Error()))
+				}
+				sources[field.name] = source
+				break
+			}
+		}
+		if value, ok := flags[field.name]; ok {
+			if err := field.set(value); err != nil {
+				problems = append(problems, fmt.Errorf("-%s: %s", field.name, err.Error()))
+			}
+			sources[field.name] = "flag"
+		}
+		values := []reflect.Value{field.value}
+		if field.value.Kind() == reflect.Slice {
+			values = nil
+			for i := 0; i < field.value.Len(); i++ {
+				values = append(values, field.value.Index(i))
+			}
+		}
+		for _, value := range values {
+			if value.Kind() != reflect.String {
+				continue
+			}
+			plain, err := decryptSetting(value.String())
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s: %s", field.name, err.Error()))
+			}
+			value.SetString(plain)
+		}
+	}
+	return settings, sources, errors.Join(problems...)
+}
+
+// Validate checks the settings, reporting every problem with the setting's
+// name and environment variable.
+func (s *Settings) Validate() error {
+	var problems []error
+	problem := func(name, env, format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf("%s (%s): %s", name, env,
+			fmt.Sprintf(format, args...)))
+	}
+	positive := func(name, env string, value int) {
+		if value <= 0 {
+			problem(name, env, "must be greater than zero, not %d", value)
+		}
+	}
+	address := func(name, env, value string) {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			problem(name, env, "%q is not host:port", value)
+		}
+	}
+	link := func(name, env, value string) {
+		if value == "" {
+			problem(name, env, "is required")
+		} else if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			problem(name, env, "%q is not an absolute URL", value)
+		}
+	}
+	file := func(name, env, value string) {
+		if value == "" {
+			return
+		}
+		if _, err := os.Stat(value); err != nil {
+			problem(name, env, "%s", err.Error())
+		}
+	}
+
+	address("server.listen", "LISTEN_ADDR", s.Server.Listen)
+	positive("server.readTimeoutSeconds", "HTTP_READ_TIMEOUT", s.Server.ReadTimeoutSeconds)
+	positive("server.readHeaderTimeoutSeconds", "HTTP_READ_HEADER_TIMEOUT",
+		s.Server.ReadHeaderTimeoutSeconds)
+	positive("server.writeTimeoutSeconds", "HTTP_WRITE_TIMEOUT", s.Server.WriteTimeoutSeconds)
+	positive("server.idleTimeoutSeconds", "HTTP_IDLE_TIMEOUT", s.Server.IdleTimeoutSeconds)
+	positive("server.maxHeaderBytes", "HTTP_MAX_HEADER_BYTES", s.Server.MaxHeaderBytes)
+	positive("server.shutdownTimeoutSeconds", "SHUTDOWN_TIMEOUT", s.Server.ShutdownTimeoutSeconds)
+	if s.Server.SettingsReloadSeconds < 0 {
+		problem("server.settingsReloadSeconds", "SETTINGS_RELOAD_SECONDS",
+			"must not be negative, not %d", s.Server.SettingsReloadSeconds)
+	}
+
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		problem("tls.certFile", "TLS_CERT_FILE", "both the certificate and key files are required")
+	}
+	file("tls.certFile", "TLS_CERT_FILE", s.TLS.CertFile)
+	file("tls.keyFile", "TLS_KEY_FILE", s.TLS.KeyFile)
+	file("tls.clientCaFile", "TLS_CLIENT_CA_FILE", s.TLS.ClientCAFile)
+	if s.TLS.MinVersion != "1.2" && s.TLS.MinVersion != "1.3" {
+		problem("tls.minVersion", "TLS_MIN_VERSION", "must be 1.2 or 1.3, not %q", s.TLS.MinVersion)
+	}
+	positive("tls.reloadSeconds", "TLS_RELOAD_SECONDS", s.TLS.ReloadSeconds)
+	if len(s.TLS.MTLSRoutes) > 0 && s.TLS.ClientCAFile == "" {
+		problem("tls.mtlsRoutes", "MTLS_ROUTES", "needs a client CA file to verify certificates")
+	}
+
+	if s.Mongo.URI == "" {
+		problem("mongo.uri", "MONGO_URI", "is required")
+	} else if !strings.HasPrefix(s.Mongo.URI, "mongodb://") &&
+		!strings.HasPrefix(s.Mongo.URI, "mongodb+srv://") {
+		problem("mongo.uri", "MONGO_URI", "must start with mongodb:// or mongodb+srv://")
+	}
+
+	if s.Security.JWTSecret == "" {
+		problem("security.jwtSecret", "JWT_SECRET", "is required")
+	}
+	if s.Security.SecurityKey == "" {
+		problem("security.securityKey", "SECURITY_KEY", "is required")
+	} else if s.Security.SecurityKey == s.Security.PreviousSecurityKey {
+		problem("security.previousSecurityKey", "SECURITY_KEY_PREVIOUS",
+			"must differ from the current key")
+	}
+	if len(s.Security.AdminRoles) == 0 {
+		problem("security.adminRoles", "ADMIN_ROLES", "at least one role is required")
+	}
+	positive("security.lockoutAttempts", "LOCKOUT_ATTEMPTS", s.Security.LockoutAttempts)
+	if s.Security.PasswordMinLength < 8 {
+		problem("security.passwordMinLength", "PASSWORD_MIN_LENGTH",
+			"must be at least 8, not %d", s.Security.PasswordMinLength)
+	}
+	positive("security.passwordMaxAgeDays", "PASSWORD_MAX_AGE_DAYS", s.Security.PasswordMaxAgeDays)
+	for _, days := range s.Security.PasswordNoticeDays {
+		positive("security.passwordNoticeDays", "PASSWORD_NOTICE_DAYS", days)
+	}
+	positive("security.resetExpiryMinutes", "RESET_EXPIRY_MINUTES", s.Security.ResetExpiryMinutes)
+
+	positive("users.retentionDays", "USER_RETENTION_DAYS", s.Users.RetentionDays)
+	positive("users.inviteExpiryHours", "INVITE_EXPIRY_HOURS", s.Users.InviteExpiryHours)
+	link("users.inviteUrl", "INVITE_URL", s.Users.InviteURL)
+	positive("users.emailChangeExpiryMinutes", "EMAIL_CHANGE_EXPIRY_MINUTES",
+		s.Users.EmailChangeExpiryMinutes)
+	link("users.emailConfirmUrl", "EMAIL_CONFIRM_URL", s.Users.EmailConfirmURL)
+	positive("users.emailRevertDays", "EMAIL_REVERT_DAYS", s.Users.EmailRevertDays)
+	link("users.emailRevertUrl", "EMAIL_REVERT_URL", s.Users.EmailRevertURL)
+
+	switch strings.ToLower(s.Email.Transport) {
+	case "smtp":
+		if s.Email.SMTPServer == "" {
+			problem("email.smtpServer", "SMTP_SERVER", "is required for the smtp transport")
+		}
+		if port, err := strconv.Atoi(s.Email.SMTPPort); err != nil || port <= 0 || port > 65535 {
+			problem("email.smtpPort", "SMTP_PORT", "%q is not a port", s.Email.SMTPPort)
+		}
+	case "file", "memory":
+	default:
+		problem("email.transport", "EMAIL_TRANSPORT", "must be smtp, file or memory, not %q",
+			s.Email.Transport)
+	}
+	if s.Email.From == "" {
+		problem("email.from", "SMTP_FROM", "is required")
+	}
+	positive("email.maxAttempts", "EMAIL_MAX_ATTEMPTS", s.Email.MaxAttempts)
+	positive("email.queueSeconds", "EMAIL_QUEUE_SECONDS", s.Email.QueueSeconds)
+	if s.Email.TemplateDir != "" {
+		if info, err := os.Stat(s.Email.TemplateDir); err != nil || !info.IsDir() {
+			problem("email.templateDir", "EMAIL_TEMPLATE_DIR", "%q is not a directory",
+				s.Email.TemplateDir)
+		}
+	}
+
+	if s.Email.SchedulerURL != "" {
+		link("email.schedulerUrl", "SCHEDULER_URL", s.Email.SchedulerURL)
+	}
+	if s.Email.MetricsURL != "" {
+		link("email.metricsUrl", "METRICS_URL", s.Email.MetricsURL)
+	}
+
+	if s.Notify.SMSGatewayURL != "" {
+		link("notify.smsGatewayUrl", "SMS_GATEWAY_URL", s.Notify.SMSGatewayURL)
+	}
+
+	if s.Audit.SigningKey == "" {
+		problem("audit.signingKey", "AUDIT_SIGNING_KEY", "is required")
+	} else if s.Audit.SigningKey == s.Security.JWTSecret {
+		problem("audit.signingKey", "AUDIT_SIGNING_KEY", "must differ from JWT_SECRET")
+	}
+	positive("audit.checkpointMinutes", "AUDIT_CHECKPOINT_MINUTES", s.Audit.CheckpointMinutes)
+	if _, err := s.auditRetention(); err != nil {
+		problem("audit.retention", "AUDIT_RETENTION", "%s", err.Error())
+	}
+	positive("audit.exportLimit", "AUDIT_EXPORT_LIMIT", s.Audit.ExportLimit)
+	if s.Audit.ArchiveDir == "" {
+		problem("audit.archiveDir", "LOG_DIR", "is required")
+	} else if !filepath.IsAbs(s.Audit.ArchiveDir) {
+		problem("audit.archiveDir", "LOG_DIR",
+			"must be an absolute path shared by every instance")
+	}
+
+	if _, err := parseLogLevel(s.Logging.Level); err != nil {
+		problem("logging.level", "LOGLEVEL", "%s", err.Error())
+	}
+
+	switch strings.ToLower(s.Tracing.Exporter) {
+	case "otlp", "stdout", "none", "":
+	case "file":
+		if s.Tracing.File == "" {
+			problem("tracing.file", "OTEL_TRACES_FILE", "is required for the file exporter")
+		}
+	default:
+		problem("tracing.exporter", "OTEL_TRACES_EXPORTER",
+			"must be otlp, stdout, file or none, not %q", s.Tracing.Exporter)
+	}
+
+	if s.Metrics.Addr != "" {
+		address("metrics.addr", "METRICS_ADDR", s.Metrics.Addr)
+	}
+	return errors.Join(problems...)
+}
+
+// SettingsDump is the current configuration with its secrets redacted, for
+// checking what a deployment is running with.
+type SettingsDump struct {
+	File     string                            `json:"file,omitempty"`
+	Settings map[string]map[string]interface{} `json:"settings"`
+	Sources  map[string]string                 `json:"sources"`
+}
+
+// DumpSettings provides the current settings with every secret redacted and
+// the source of each value.  The sources are copied, as a reload replaces
+// them while the dump is encoded.
+func DumpSettings() SettingsDump {
+	settingsMutex.Lock()
+	dump := SettingsDump{
+		File:     settingsFile,
+		Settings: make(map[string]map[string]interface{}),
+		Sources:  make(map[string]string, len(settingsSources)),
+	}
+	for name, source := range settingsSources {
+		dump.Sources[name] = source
+	}
+	settingsMutex.Unlock()
+	for _, field := range GetSettings().fields() {
+		parts := strings.SplitN(field.name, ".", 2)
+		if dump.Settings[parts[0]] == nil {
+			dump.Settings[parts[0]] = make(map[string]interface{})
+		}
+		var value interface{} = field.value.Interface()
+		if field.secret && field.String() != "" {
+			value = redacted
+		}
+		dump.Settings[parts[0]][parts[1]] = value
+	}
+	return dump
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+// validSettings provides the defaults with the settings which have none.
+func validSettings() *Settings {
+	s := DefaultSettings()
+	s.Mongo.URI = "mongodb://localhost"
+	s.Security.JWTSecret = "secret"
+	s.Security.SecurityKey = "key"
+	s.Audit.SigningKey = "audit-key"
+	s.Audit.ArchiveDir = "/var/log/authenticate"
+	s.Users.InviteURL = "https://auth.example.com/invite"
+	s.Users.EmailConfirmURL = "https://auth.example.com/email/confirm"
+	s.Users.EmailRevertURL = "https://auth.example.com/email/revert"
+	s.Email.From = "noreply@example.com"
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	if err := validSettings().Validate(); err != nil {
+		t.Fatalf("valid settings reported: %s", err.Error())
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(*Settings)
+		want   string
+	}{
+		{"no mongo uri", func(s *Settings) { s.Mongo.URI = "" }, "mongo.uri (MONGO_URI)"},
+		{"no security key", func(s *Settings) { s.Security.SecurityKey = "" },
+			"security.securityKey (SECURITY_KEY)"},
+		{"no audit signing key", func(s *Settings) { s.Audit.SigningKey = "" },
+			"audit.signingKey (AUDIT_SIGNING_KEY)"},
+		{"audit key is the jwt secret", func(s *Settings) { s.Audit.SigningKey = "secret" },
+			"audit.signingKey"},
+		{"relative archive dir", func(s *Settings) { s.Audit.ArchiveDir = "logs" },
+			"audit.archiveDir (LOG_DIR)"},
+		{"mongo scheme", func(s *Settings) { s.Mongo.URI = "http://db" }, "mongo.uri"},
+		{"listen", func(s *Settings) { s.Server.Listen = "6000" }, "server.listen"},
+		{"lockout", func(s *Settings) { s.Security.LockoutAttempts = 0 },
+			"security.lockoutAttempts (LOCKOUT_ATTEMPTS)"},
+		{"password length", func(s *Settings) { s.Security.PasswordMinLength = 6 },
+			"security.passwordMinLength"},
+		{"relative link", func(s *Settings) { s.Users.InviteURL = "/invite" },
+			"users.inviteUrl"},
+		{"transport", func(s *Settings) { s.Email.Transport = "pigeon" },
+			"email.transport"},
+		{"half a key pair", func(s *Settings) { s.TLS.CertFile = "cert.pem" },
+			"tls.certFile"},
+	} {
+		s := validSettings()
+		tc.change(s)
+		err := s.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	s := validSettings()
+	s.Mongo.URI = ""
+	s.Security.JWTSecret = ""
+	s.Email.From = ""
+	err := s.Validate()
+	if err == nil {
+		t.Fatal("no problems reported")
+	}
+	for _, name := range []string{"mongo.uri", "security.jwtSecret", "email.from"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s not reported in %q", name, err.Error())
+		}
+	}
+}
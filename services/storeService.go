@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/erneap/go-models/employees"
+	"github.com/erneap/go-models/svcs"
+	"github.com/erneap/go-models/users"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The stores keep the service's users, employees, audit trail, login
+// sessions and the records logging in, inviting users, changing email
+// addresses, resetting passwords and verifying the audit trail rely on.  The handlers reach them through
+// GetStores, so the MongoDB stores used in production can be replaced by the
+// in-memory stores to run without a database.  The few records only kept in
+// MongoDB, such as the audit rollups, fail with ErrNoDatabase without it.
+// Both report a missing record with mongo.ErrNoDocuments.  The context given
+// to each call is the request's, so the calls are traced and stop when the
+// client goes away.
+
+// UserStore keeps the user accounts.
+type UserStore interface {
+	GetByID(ctx context.Context, id string) (*users.User, error)
+	// GetByEmail finds the user without regard to the address's case.
+	GetByEmail(ctx context.Context, email string) (*users.User, error)
+	GetByName(ctx context.Context, first, last string) (*users.User, error)
+	GetAll(ctx context.Context) ([]users.User, error)
+	// Create adds a user with the password, providing the new record.
+	Create(ctx context.Context, email, first, middle, last,
+		passwd string) (*users.User, error)
+	// Insert adds the user as given, keeping its ID.
+	Insert(ctx context.Context, user users.User) error
+	Update(ctx context.Context, user users.User) error
+	Delete(ctx context.Context, id string) error
+}
+
+// EmployeeStore keeps the scheduler's employee records.
+type EmployeeStore interface {
+	GetByID(ctx context.Context, id primitive.ObjectID) (*employees.Employee, error)
+	GetByName(ctx context.Context, first, middle,
+		last string) (*employees.Employee, error)
+	// GetInTeam finds the team's employee by name, a blank middle name
+	// matching any.
+	GetInTeam(ctx context.Context, teamID primitive.ObjectID, first, middle,
+		last string) (*employees.Employee, error)
+	// GetAll provides the team's employees, at the site when one is given.
+	GetAll(ctx context.Context, teamID primitive.ObjectID,
+		siteID string) ([]employees.Employee, error)
+	Insert(ctx context.Context, emp employees.Employee) error
+	Update(ctx context.Context, emp employees.Employee) error
+	// Delete removes the employee, reporting whether there was one.
+	Delete(ctx context.Context, id primitive.ObjectID) (bool, error)
+}
+
+// ErrAuditSeqTaken is returned when another event was written with the same
+// chain sequence first.
+var ErrAuditSeqTaken = errors.New("audit sequence already used")
+
+// AuditStore keeps the audit trail.
+type AuditStore interface {
+	// Last provides the newest event in the hash chain, or nil when empty.
+	Last(ctx context.Context) (*AuditEvent, error)
+	// Insert adds the event, failing with ErrAuditSeqTaken when its sequence
+	// is already used.
+	Insert(ctx context.Context, evt AuditEvent) error
+	// Find provides the events matching the filter, newest first.
+	Find(ctx context.Context, filter AuditFilter, skip,
+		limit int64) ([]AuditEvent, error)
+	Count(ctx context.Context, filter AuditFilter) (int64, error)
+	// Walk calls fn with each event in the hash chain in sequence order,
+	// stopping at the first error.
+	Walk(ctx context.Context, fn func(AuditEvent) error) error
+	// LastCheckpoint provides the newest checkpoint, or nil when none.
+	LastCheckpoint(ctx context.Context) (*AuditCheckpoint, error)
+	InsertCheckpoint(ctx context.Context, cp AuditCheckpoint) error
+	Checkpoints(ctx context.Context) ([]AuditCheckpoint, error)
+	// Archives provides the records of the archive files with their links.
+	Archives(ctx context.Context) ([]AuditArchive, error)
+}
+
+// SessionStore issues the login tokens and remembers the devices users log
+// in from.  Tokens are always JWTs, as the go-models middleware checks them.
+type SessionStore interface {
+	CreateToken(id primitive.ObjectID, email string) (string, error)
+	ValidateToken(token string) (*svcs.JWTClaim, error)
+	// TouchDevice records the login from the device, reporting whether the
+	// device is new and whether the user had logged in from others before.
+	TouchDevice(ctx context.Context, userID primitive.ObjectID, ip,
+		userAgent string, now time.Time) (isNew, hadOthers bool, err error)
+}
+
+// AccountStore keeps what decides whether a user may log in besides the
+// password: the account statuses, the deactivation marks, the tokens for
+// changing an expired password and the notices sent before it expires.
+type AccountStore interface {
+	GetStatus(ctx context.Context, id primitive.ObjectID) (*AccountStatus, error)
+	// SaveStatus adds or replaces the user's status.
+	SaveStatus(ctx context.Context, status AccountStatus) error
+	DeleteStatus(ctx context.Context, id primitive.ObjectID) error
+	// ExpireStatuses marks the active accounts whose end date is before now
+	// as expired, providing the number changed.
+	ExpireStatuses(ctx context.Context, now time.Time) (int, error)
+	// MarkDeleted records the deactivation, keeping any earlier mark.
+	MarkDeleted(ctx context.Context, mark DeletedUser) error
+	GetDeleted(ctx context.Context, id primitive.ObjectID) (*DeletedUser, error)
+	GetAllDeleted(ctx context.Context) ([]DeletedUser, error)
+	// Restore removes the deactivation mark, reporting whether there was one.
+	Restore(ctx context.Context, id primitive.ObjectID) (bool, error)
+	// SavePasswordChange replaces any password change token of the user.
+	SavePasswordChange(ctx context.Context, change PasswordChangeToken) error
+	// GetPasswordChange finds the password change token by its hash.
+	GetPasswordChange(ctx context.Context,
+		tokenHash string) (*PasswordChangeToken, error)
+	DeletePasswordChange(ctx context.Context, id primitive.ObjectID) error
+	// GetExpiryNotice provides the record of the expiry notices sent to the
+	// user.
+	GetExpiryNotice(ctx context.Context, id primitive.ObjectID) (*ExpiryNotice, error)
+	// SaveExpiryNotice adds or replaces the user's record of notices sent.
+	SaveExpiryNotice(ctx context.Context, notice ExpiryNotice) error
+}
+
+// InvitationStore keeps the invitations of new users, by user ID.
+type InvitationStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Invitation, error)
+	// Save adds or replaces the invitation.
+	Save(ctx context.Context, invite Invitation) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// EmailChangeStore keeps the users' pending email changes, by user ID, and the
+// links for reverting the confirmed ones.
+type EmailChangeStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*EmailChange, error)
+	// Save adds or replaces the user's pending change.
+	Save(ctx context.Context, change EmailChange) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// IsPending reports whether a change to the address, without regard to
+	// its case, by a user other than the one given is unexpired at the time.
+	IsPending(ctx context.Context, email string, exceptID primitive.ObjectID,
+		now time.Time) (bool, error)
+	InsertRevert(ctx context.Context, revert EmailRevert) error
+	// GetRevert finds the revert link by the hash of its token.
+	GetRevert(ctx context.Context, tokenHash string) (*EmailRevert, error)
+	// MarkReverted records the time the change was reverted.
+	MarkReverted(ctx context.Context, id primitive.ObjectID, now time.Time) error
+}
+
+// NotificationStore keeps the users' contact preferences and the security
+// alert settings changed from their defaults.
+type NotificationStore interface {
+	GetContact(ctx context.Context, id primitive.ObjectID) (*ContactPreference, error)
+	// SaveContact adds or replaces the contact preference.
+	SaveContact(ctx context.Context, pref ContactPreference) error
+	GetAlertSettings(ctx context.Context) ([]AlertSetting, error)
+	// SaveAlertSetting adds or replaces the setting for its event.
+	SaveAlertSetting(ctx context.Context, setting AlertSetting) error
+}
+
+// OutboxStore keeps the email messages queued for delivery.
+type OutboxStore interface {
+	Insert(ctx context.Context, msg OutboxMessage) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (*OutboxMessage, error)
+	// Claim marks the message due first as sending, locked until the time
+	// given, and provides it.  A sending message whose lock has expired is
+	// due again.
+	Claim(ctx context.Context, now, lockedUntil time.Time) (*OutboxMessage, error)
+	// Update replaces the message with the one given.
+	Update(ctx context.Context, msg OutboxMessage) error
+	// Find provides the messages with the status, or all when blank, newest
+	// first.
+	Find(ctx context.Context, status string, limit int64) ([]OutboxMessage, error)
+}
+
+// Stores are the stores the service runs with.
+type Stores struct {
+	Users         UserStore
+	Employees     EmployeeStore
+	Audit         AuditStore
+	Sessions      SessionStore
+	Accounts      AccountStore
+	Invitations   InvitationStore
+	EmailChanges  EmailChangeStore
+	Notifications NotificationStore
+	Outbox        OutboxStore
+}
+
+var (
+	stores      *Stores
+	storesMutex sync.Mutex
+)
+
+// GetStores provides the stores in use, the MongoDB stores unless replaced.
+func GetStores() *Stores {
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	if stores == nil {
+		stores = NewMongoStores()
+	}
+	return stores
+}
+
+// SetStores replaces the stores, used to run the handlers with the in-memory
+// stores.
+func SetStores(s *Stores) {
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	stores = s
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TLS is served when TLS_CERT_FILE and TLS_KEY_FILE are set, with the lowest
+// protocol version from TLS_MIN_VERSION ("1.2" or "1.3", default "1.2").  With
+// TLS_CLIENT_CA_FILE, client certificates signed by those CAs are verified
+// when offered, and required on the paths under the prefixes in MTLS_ROUTES.
+// The files are checked for changes every TLS_RELOAD_SECONDS (default 60) and
+// reloaded without a restart.
+//
+// TLS_CLIENT_IDENTITIES maps client certificate subjects to service
+// identities as a semicolon separated list of subject=identity, where the
+// subject is either the full distinguished name or CN=<common name>, e.g.
+// "CN=scheduler-api=scheduler;CN=metrics-api=metrics".
+
+// tlsFiles holds the current certificate and client CAs, reloading them when
+// the files change.
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modified map[string]time.Time
+}
+
+func (t *tlsFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", t.caFile)
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.cert = &cert
+	t.clientCA = pool
+	t.modified = t.modTimes()
+	return nil
+}
+
+func (t *tlsFiles) modTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, file := range []string{t.certFile, t.keyFile, t.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// reloadIfChanged reloads the files when any has changed.  A failed reload
+// keeps the files loaded before.
+func (t *tlsFiles) reloadIfChanged() error {
+	t.mutex.RLock()
+	changed := false
+	for file, modified := range t.modTimes() {
+		if !modified.Equal(t.modified[file]) {
+			changed = true
+		}
+	}
+	t.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+	if err := t.load(); err != nil {
+		return fmt.Errorf("tls reload: %s", err.Error())
+	}
+	Logger.Info("TLS certificates reloaded")
+	return nil
+}
+
+func (t *tlsFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.cert, nil
+}
+
+// NewTLSConfig provides the listener's TLS configuration, or nil when TLS
+// isn't configured.
+func NewTLSConfig() (*tls.Config, error) {
+	files := &tlsFiles{
+		certFile: GetSettings().TLS.CertFile,
+		keyFile:  GetSettings().TLS.KeyFile,
+		caFile:   GetSettings().TLS.ClientCAFile,
+	}
+	if files.certFile == "" && files.keyFile == "" {
+		return nil, nil
+	}
+	if files.certFile == "" || files.keyFile == "" {
+		return nil, errors.New("both TLS_CERT_FILE and TLS_KEY_FILE are required")
+	}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+
+	var minVersion uint16
+	switch GetSettings().TLS.MinVersion {
+	case "1.2":
+		minVersion = tls.VersionTLS12
+	case "1.3":
+		minVersion = tls.VersionTLS13
+	default:
+		return nil, errors.New("TLS_MIN_VERSION must be 1.2 or 1.3")
+	}
+
+	base := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: files.getCertificate,
+	}
+	if files.caFile != "" {
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			files.mutex.RLock()
+			defer files.mutex.RUnlock()
+			cfg := base.Clone()
+			cfg.GetConfigForClient = nil
+			cfg.ClientCAs = files.clientCA
+			return cfg, nil
+		}
+	}
+
+	RunPeriodically("ReloadTLS",
+		time.Duration(GetSettings().TLS.ReloadSeconds)*time.Second,
+		func(context.Context) error { return files.reloadIfChanged() })
+	return base, nil
+}
+
+// getClientIdentities provides the service identity for each certificate
+// subject from TLS_CLIENT_IDENTITIES.
+func getClientIdentities() map[string]string {
+	return GetSettings().TLS.ClientIdentities
+}
+
+// ClientIdentity provides the service identity of the request's verified
+// client certificate, or "" when there is none or its subject isn't mapped.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	identities := getClientIdentities()
+	if identity, ok := identities[cert.Subject.String()]; ok {
+		return identity
+	}
+	return identities["CN="+cert.Subject.CommonName]
+}
+
+// ClientCertificates is middleware requiring a verified, mapped client
+// certificate on the paths under the MTLS_ROUTES prefixes.  The service
+// identity is available to handlers as "serviceidentity".
+func ClientCertificates() gin.HandlerFunc {
+	prefixes := GetSettings().TLS.MTLSRoutes
+	return func(c *gin.Context) {
+		identity := ClientIdentity(c.Request)
+		if identity != "" {
+			c.Set("serviceidentity", identity)
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) && identity == "" {
+				RequestLogger(c).Warn("client certificate required",
+					"path", c.Request.URL.Path)
+				c.AbortWithStatusJSON(http.StatusForbidden,
+					gin.H{"exception": "client certificate required"})
+				return
+			}
+		}
+		c.Next()
+	}
+}